@@ -0,0 +1,223 @@
+package tun2socks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StartFromJSON is like Start but takes the whole configuration as one JSON
+// object, so new settings can be added without changing the signature:
+//
+//	{
+//	  "proxy": "socks5://1.2.3.4:1080",
+//	  "logLevel": "info",
+//	  "mtu": 1500,
+//	  "dns": "1.1.1.1:53",
+//	  "udpEnabled": true,
+//	  "bypassCIDRs": ["10.0.0.0/8", "192.168.0.0/16"]
+//	}
+//
+// proxy is required and logLevel defaults to "info". "dns", "udpEnabled"
+// and "bypassCIDRs" apply as their Set* functions do and keep their current
+// value when left out. Unknown fields are ignored; a field of the wrong
+// type is an error. If StartFromJSON fails, the settings are left as they
+// were.
+func StartFromJSON(tunFd int, configJSON string) error {
+	c, err := parseConfig(configJSON)
+	if err != nil {
+		return err
+	}
+	return start(&startParams{tunFd: tunFd, proxyUrl: c.Proxy, logLevel: c.LogLevel, mtu: c.MTU, config: c})
+}
+
+// config is the JSON form of the StartFromJSON configuration.
+type config struct {
+	Proxy      string  `json:"proxy"`
+	LogLevel   string  `json:"logLevel"`
+	MTU        int     `json:"mtu"`
+	DNS        *string `json:"dns"`
+	UDPEnabled *bool   `json:"udpEnabled"`
+	// BypassCIDRs is nil when left out; an empty list clears the bypass.
+	BypassCIDRs []string `json:"bypassCIDRs"`
+
+	// Parsed forms, set by parseConfig.
+	dnsIP   net.IP
+	dnsPort uint16
+	bypass  []*net.IPNet
+}
+
+// parseConfig decodes and validates s, so that start does not fail over it
+// after applying the options. The proxy and fd are validated by start.
+func parseConfig(s string) (*config, error) {
+	c := &config{LogLevel: "info"}
+	if err := json.Unmarshal([]byte(s), c); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		return nil, fmt.Errorf("invalid config: logLevel: %w", err)
+	}
+	if c.MTU != 0 && (c.MTU < minMTU || c.MTU > maxMTU) {
+		return nil, fmt.Errorf("invalid config: mtu %d: must be between %d and %d", c.MTU, minMTU, maxMTU)
+	}
+	if c.DNS != nil && *c.DNS != "" {
+		var err error
+		if c.dnsIP, c.dnsPort, err = splitIPPort(*c.DNS); err != nil {
+			return nil, fmt.Errorf("invalid config: dns: %w", err)
+		}
+	}
+	if c.BypassCIDRs != nil {
+		var err error
+		if c.bypass, err = parseCIDRs(strings.Join(c.BypassCIDRs, ",")); err != nil {
+			return nil, fmt.Errorf("invalid config: bypassCIDRs: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// apply stores the options set in c and returns a func that restores the
+// previous ones. Callers must hold lifecycleMu.
+func (c *config) apply() (restore func()) {
+	dnsIP, dnsPort := options.dnsIP, options.dnsPort
+	udpDisabled, bypass := options.udpDisabled, options.bypassCIDRs
+	restore = func() {
+		options.dnsIP, options.dnsPort = dnsIP, dnsPort
+		options.udpDisabled, options.bypassCIDRs = udpDisabled, bypass
+	}
+
+	if c.DNS != nil {
+		options.dnsIP, options.dnsPort = c.dnsIP, c.dnsPort
+	}
+	if c.UDPEnabled != nil {
+		options.udpDisabled = !*c.UDPEnabled
+	}
+	if c.BypassCIDRs != nil {
+		options.bypassCIDRs = c.bypass
+	}
+	return restore
+}
+
+// CurrentConfig returns the settings in effect for the running engine as a
+// JSON object, after defaults and live changes (SetLogLevel, Restart,
+// Reconfigure, ...) are applied. Proxy passwords and the REST API token
+// are replaced by "redacted", so the output can go into a bug report.
+// Settings that only apply on the next Start show their value for the
+// current session. It returns "{}" when not running.
+func CurrentConfig() string {
+	lifecycleMu.Lock()
+	c := currentConfig()
+	lifecycleMu.Unlock()
+
+	if c == nil {
+		return "{}"
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+// currentConfig returns the CurrentConfig settings, or nil when not
+// running. Callers must hold lifecycleMu.
+func currentConfig() *effectiveConfig {
+	s := currentSession
+	if s == nil {
+		return nil
+	}
+	d := s.dispatcher
+	c := &effectiveConfig{
+		Proxy:             redactURL(s.key.Proxy),
+		LogLevel:          s.key.LogLevel,
+		MTU:               s.key.MTU,
+		UDPEnabled:        !d.noUDP,
+		UDPTimeout:        int(s.key.UDPTimeout / time.Second),
+		DialTimeout:       int(d.dialTimeout / time.Millisecond),
+		TCPSendBuffer:     s.key.TCPSendBufferSize,
+		TCPReceiveBuffer:  s.key.TCPReceiveBufferSize,
+		OutboundInterface: s.key.Interface,
+		IdleTimeout:       int(options.idleTimeout / time.Second),
+		AutoReconnect:     options.autoReconnect,
+		DomainRules:       len(d.rules),
+	}
+	if u, err := url.Parse(restAPIURL(s.key.RestAPI)); err == nil && s.key.RestAPI != "" {
+		if u.User != nil {
+			u.User = url.User("redacted") /* the token */
+		}
+		c.RestAPI = u.String()
+	}
+	for _, u := range s.proxyUrls {
+		c.Proxies = append(c.Proxies, redactURL(u))
+	}
+	if d.dnsIP != nil {
+		c.DNS = net.JoinHostPort(d.dnsIP.String(), strconv.Itoa(int(d.dnsPort)))
+	}
+	c.BypassCIDRs = cidrStrings(d.bypass)
+	c.BlockCIDRs = cidrStrings(d.block)
+	c.AllowCIDRs = cidrStrings(d.allow)
+	if d.fake != nil {
+		c.FakeIP = d.fake.net.String()
+	}
+	if l := rateLimiter.Load(); l != nil {
+		c.RateLimit = int(l.Limit())
+	}
+	return c
+}
+
+// effectiveConfig is the JSON form of CurrentConfig. Its names match the
+// StartFromJSON config where both have a field.
+type effectiveConfig struct {
+	Proxy             string   `json:"proxy"`
+	Proxies           []string `json:"proxies,omitempty"`
+	LogLevel          string   `json:"logLevel"`
+	MTU               int      `json:"mtu"`
+	DNS               string   `json:"dns,omitempty"`
+	UDPEnabled        bool     `json:"udpEnabled"`
+	UDPTimeout        int      `json:"udpTimeoutSeconds"`
+	DialTimeout       int      `json:"dialTimeoutMs"`
+	BypassCIDRs       []string `json:"bypassCIDRs,omitempty"`
+	BlockCIDRs        []string `json:"blockCIDRs,omitempty"`
+	AllowCIDRs        []string `json:"allowOnlyCIDRs,omitempty"`
+	TCPSendBuffer     string   `json:"tcpSendBufferSize,omitempty"`
+	TCPReceiveBuffer  string   `json:"tcpReceiveBufferSize,omitempty"`
+	OutboundInterface string   `json:"outboundInterface,omitempty"`
+	RestAPI           string   `json:"restAPI,omitempty"`
+	IdleTimeout       int      `json:"idleTimeoutSeconds"`
+	RateLimit         int      `json:"rateLimit"`
+	AutoReconnect     bool     `json:"autoReconnect"`
+	DomainRules       int      `json:"domainRules"`
+	FakeIP            string   `json:"fakeIPRange,omitempty"`
+}
+
+func cidrStrings(nets []*net.IPNet) []string {
+	var out []string
+	for _, n := range nets {
+		out = append(out, n.String())
+	}
+	return out
+}
+
+// redactURL replaces the secrets in a proxy or REST API URL: the password,
+// or a username given alone, which is then the credential (a SOCKS4 user
+// ID, an HTTP token, the base64 userinfo of Shadowsocks).
+func redactURL(s string) string {
+	if s == "" {
+		return ""
+	}
+	u, err := parseProxyURL(s)
+	if err != nil {
+		return "redacted"
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "redacted")
+		} else {
+			u.User = url.User("redacted")
+		}
+	}
+	return u.String()
+}
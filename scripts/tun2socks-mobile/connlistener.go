@@ -0,0 +1,205 @@
+package tun2socks
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// connQueueSize bounds the events waiting for a listener.
+	connQueueSize = 256
+
+	// connEventsPerSecond caps the events queued per second, so a burst of
+	// new flows (e.g. a browser opening a page) cannot flood the UI.
+	connEventsPerSecond = 100
+)
+
+// ConnectionListener is notified of proxied flows, e.g. to show a live
+// connection log. proto is "tcp" or "udp"; the addresses are "host:port"
+// as seen by the app, before any DNS redirect.
+type ConnectionListener interface {
+	// OnConnection is called once a flow has been dialed.
+	OnConnection(proto, srcAddr, dstAddr string)
+	// OnConnectionClosed is called when the flow closes, with the bytes
+	// sent to and received from the remote end.
+	OnConnectionClosed(proto, srcAddr, dstAddr string, uploaded, downloaded int64)
+}
+
+// connListenerHolder is a registered listener with its own queue and
+// delivery goroutine, so a listener that blocks only ever holds up its own
+// events.
+type connListenerHolder struct {
+	l      ConnectionListener
+	events chan connEvent
+	done   chan struct{}
+}
+
+type connEvent struct {
+	f      *flow
+	closed bool
+}
+
+var (
+	connListener  atomic.Pointer[connListenerHolder]
+	connEventRate rateWindow
+)
+
+// SetConnectionListener registers l for flow events; nil removes it. It
+// may be called before or after Start and applies to new flows.
+//
+// Events are delivered on a goroutine of their own, at most 100 per
+// second. Events beyond that, or while l is behind, are dropped, so a
+// close may be reported without its open or the other way round. A
+// listener that never returns loses all its later events but does not
+// hold up the engine, and one set after it gets events again. While a
+// listener is set every flow pays a small cost for counting its bytes.
+func SetConnectionListener(l ConnectionListener) {
+	var h *connListenerHolder
+	if l != nil {
+		h = &connListenerHolder{
+			l:      l,
+			events: make(chan connEvent, connQueueSize),
+			done:   make(chan struct{}),
+		}
+		go h.deliver()
+	}
+	if old := connListener.Swap(h); old != nil {
+		close(old.done)
+	}
+}
+
+// deliver calls the listener for each queued event until it is replaced.
+func (h *connListenerHolder) deliver() {
+	for {
+		select {
+		case <-h.done:
+			return
+		case e := <-h.events:
+			if connListener.Load() != h {
+				return
+			}
+			if e.closed {
+				h.l.OnConnectionClosed(e.f.proto, e.f.src, e.f.dst, e.f.up.Load(), e.f.down.Load())
+			} else {
+				h.l.OnConnection(e.f.proto, e.f.src, e.f.dst)
+			}
+		}
+	}
+}
+
+func notifyConn(e connEvent) {
+	h := connListener.Load()
+	if h == nil || !connEventRate.allow(connEventsPerSecond) {
+		return
+	}
+	select {
+	case h.events <- e:
+	default: /* listener is behind, drop */
+	}
+}
+
+// rateWindow counts events in one-second windows.
+type rateWindow struct {
+	mu    sync.Mutex
+	start time.Time
+	n     int
+}
+
+func (w *rateWindow) allow(limit int) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if now := time.Now(); now.Sub(w.start) >= time.Second {
+		w.start, w.n = now, 0
+	}
+	if w.n >= limit {
+		return false
+	}
+	w.n++
+	return true
+}
+
+// flow is one proxied connection reported to the listener.
+type flow struct {
+	proto, src, dst string
+	up, down        atomic.Int64
+	closeOnce       sync.Once
+}
+
+func (f *flow) close() {
+	f.closeOnce.Do(func() { notifyConn(connEvent{f: f, closed: true}) })
+}
+
+// newFlow reports a new flow, or returns nil when no listener is set.
+func newFlow(proto, src, dst string) *flow {
+	if connListener.Load() == nil {
+		return nil
+	}
+	f := &flow{proto: proto, src: src, dst: dst}
+	notifyConn(connEvent{f: f})
+	return f
+}
+
+// trackConn counts c's bytes for the listener, if one is set.
+func trackConn(c net.Conn, src, dst string) net.Conn {
+	f := newFlow("tcp", src, dst)
+	if f == nil {
+		return c
+	}
+	return &trackedConn{Conn: c, f: f}
+}
+
+// trackPacketConn is trackConn for UDP.
+func trackPacketConn(pc net.PacketConn, src, dst string) net.PacketConn {
+	f := newFlow("udp", src, dst)
+	if f == nil {
+		return pc
+	}
+	return &trackedPacketConn{PacketConn: pc, f: f}
+}
+
+type trackedConn struct {
+	net.Conn
+	f *flow
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.f.down.Add(int64(n))
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.f.up.Add(int64(n))
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	c.f.close()
+	return c.Conn.Close()
+}
+
+type trackedPacketConn struct {
+	net.PacketConn
+	f *flow
+}
+
+func (c *trackedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	c.f.down.Add(int64(n))
+	return n, addr, err
+}
+
+func (c *trackedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	c.f.up.Add(int64(n))
+	return n, err
+}
+
+func (c *trackedPacketConn) Close() error {
+	c.f.close()
+	return c.PacketConn.Close()
+}
@@ -0,0 +1,140 @@
+package tun2socks
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+)
+
+type connRecorder struct {
+	opened chan string
+	closed chan [2]int64
+}
+
+func (r *connRecorder) OnConnection(proto, srcAddr, dstAddr string) {
+	r.opened <- proto + " " + srcAddr + " " + dstAddr
+}
+
+func (r *connRecorder) OnConnectionClosed(proto, srcAddr, dstAddr string, uploaded, downloaded int64) {
+	r.closed <- [2]int64{uploaded, downloaded}
+}
+
+func TestConnectionListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("hello"))
+		c.Read(make([]byte, 16))
+	}()
+
+	rec := &connRecorder{opened: make(chan string, 1), closed: make(chan [2]int64, 1)}
+	SetConnectionListener(rec)
+	defer SetConnectionListener(nil)
+
+	lnAddr := ln.Addr().(*net.TCPAddr)
+	metadata := &M.Metadata{
+		Network: M.TCP,
+		SrcIP:   net.IPv4(10, 0, 0, 2),
+		SrcPort: 40000,
+		DstIP:   lnAddr.IP,
+		DstPort: uint16(lnAddr.Port),
+	}
+	c, err := newDispatcher(proxy.NewDirect()).DialContext(context.Background(), metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Read(make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("hi"))
+	c.Close()
+
+	want := "tcp 10.0.0.2:40000 " + ln.Addr().String()
+	select {
+	case got := <-rec.opened:
+		if got != want {
+			t.Errorf("OnConnection = %q, want %q", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnConnection not called")
+	}
+	select {
+	case got := <-rec.closed:
+		if got != [2]int64{2, 5} {
+			t.Errorf("OnConnectionClosed bytes = %v, want [2 5]", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnConnectionClosed not called")
+	}
+}
+
+// resetConnEventRate lets the next events through the per-second cap.
+func resetConnEventRate() {
+	connEventRate.mu.Lock()
+	connEventRate.n = 0
+	connEventRate.mu.Unlock()
+}
+
+// stuckConnListener blocks in OnConnection until release is closed.
+type stuckConnListener struct {
+	entered, release chan struct{}
+}
+
+func (l *stuckConnListener) OnConnection(string, string, string) {
+	close(l.entered)
+	<-l.release
+}
+
+func (l *stuckConnListener) OnConnectionClosed(string, string, string, int64, int64) {}
+
+func TestBlockedConnectionListener(t *testing.T) {
+	defer SetConnectionListener(nil)
+	resetConnEventRate()
+
+	stuck := &stuckConnListener{entered: make(chan struct{}), release: make(chan struct{})}
+	defer close(stuck.release)
+	SetConnectionListener(stuck)
+	newFlow("tcp", "10.0.0.2:40000", "192.0.2.1:443")
+	select {
+	case <-stuck.entered:
+	case <-time.After(time.Second):
+		t.Fatal("OnConnection not called")
+	}
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*connQueueSize; i++ {
+			newFlow("tcp", "10.0.0.2:40001", "192.0.2.1:443")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("new flows wait for a blocked listener")
+	}
+
+	rec := &connRecorder{opened: make(chan string, 1), closed: make(chan [2]int64, 1)}
+	SetConnectionListener(rec)
+	resetConnEventRate()
+	newFlow("udp", "10.0.0.2:40002", "192.0.2.1:53")
+	select {
+	case got := <-rec.opened:
+		if want := "udp 10.0.0.2:40002 192.0.2.1:53"; got != want {
+			t.Errorf("OnConnection = %q, want %q", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Error("listener set after a blocked one got no event")
+	}
+}
@@ -0,0 +1,186 @@
+package tun2socks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/xjasonlyu/tun2socks/v2/core/device"
+	"github.com/xjasonlyu/tun2socks/v2/core/device/iobased"
+)
+
+// tunDevice is the link endpoint for a TUN fd, or for the packet listener
+// of StartListener. Unlike the engine's fd driver it reads and writes
+// through tunIO, so the wrapper sees every packet and every I/O error.
+type tunDevice struct {
+	*iobased.Endpoint
+
+	kind, name string
+	rw         *tunIO
+}
+
+var _ device.Device = (*tunDevice)(nil)
+
+// packetFile is what a tunDevice moves packets over, one per Read or
+// Write.
+type packetFile interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+}
+
+// openDevice opens the device of an engine.Key: "fd://N" or
+// "udp://host:port".
+func openDevice(dev string, mtu uint32, onFail func(error)) (*tunDevice, error) {
+	scheme, addr, _ := strings.Cut(dev, "://")
+	switch scheme {
+	case "fd":
+		fd, err := strconv.Atoi(addr)
+		if err != nil {
+			break
+		}
+		return openTunDevice(fd, mtu, onFail)
+	case "udp":
+		return openListenerDevice(addr, mtu, onFail)
+	}
+	return nil, fmt.Errorf("unsupported device: %s", dev)
+}
+
+// openTunDevice wraps fd in a tunDevice. onFail is called once, from the
+// packet loop, if the fd stops working before Close, e.g. because Android
+// revoked the VPN and closed it underneath us.
+func openTunDevice(fd int, mtu uint32, onFail func(error)) (*tunDevice, error) {
+	// A non-blocking fd makes the os.File pollable, so Close interrupts a
+	// pending Read instead of waiting for the next packet.
+	if err := unix.SetNonblock(fd, true); err != nil {
+		return nil, fmt.Errorf("set nonblock on fd %d: %w", fd, err)
+	}
+	file := os.NewFile(uintptr(fd), "tun"+strconv.Itoa(fd))
+	return newTunDevice("fd", strconv.Itoa(fd), file, mtu, onFail)
+}
+
+func newTunDevice(kind, name string, file packetFile, mtu uint32, onFail func(error)) (*tunDevice, error) {
+	rw := &tunIO{
+		file:      file,
+		onFail:    onFail,
+		firstRead: make(chan struct{}),
+	}
+	rw.ctx, rw.cancel = context.WithCancel(context.Background())
+	ep, err := iobased.New(rw, mtu, 0)
+	if err != nil {
+		rw.file.Close()
+		return nil, fmt.Errorf("create endpoint: %w", err)
+	}
+	return &tunDevice{Endpoint: ep, kind: kind, name: name, rw: rw}, nil
+}
+
+func (d *tunDevice) Name() string {
+	return d.name
+}
+
+func (d *tunDevice) Type() string {
+	return d.kind
+}
+
+// Close closes the fd or listener. I/O errors caused by closing are not
+// failures.
+func (d *tunDevice) Close() error {
+	d.rw.closed.Store(true)
+	d.rw.cancel()
+	return d.rw.file.Close()
+}
+
+// detach stops the endpoint's read loop without closing the fd, so a new
+// endpoint can take it over. The loop ends once the pending Read returns.
+func (d *tunDevice) detach() error {
+	return d.rw.file.SetReadDeadline(time.Unix(1, 0))
+}
+
+// reattach replaces the detached endpoint with one for mtu. The old
+// endpoint's loops must have exited.
+func (d *tunDevice) reattach(mtu uint32) error {
+	ep, err := iobased.New(d.rw, mtu, 0)
+	if err != nil {
+		return fmt.Errorf("create endpoint: %w", err)
+	}
+	if err := d.rw.file.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+	d.Endpoint = ep
+	return nil
+}
+
+// tunIO is the io.ReadWriter the endpoint's packet loops run on.
+type tunIO struct {
+	file   packetFile
+	closed atomic.Bool
+
+	// paused drops packets both ways; see Pause.
+	paused atomic.Bool
+
+	// ctx ends with Close, releasing packet loops waiting on the rate
+	// limit.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// firstRead is closed once the first packet has been read.
+	firstRead     chan struct{}
+	firstReadOnce sync.Once
+
+	failOnce sync.Once
+	onFail   func(error)
+}
+
+func (t *tunIO) Read(p []byte) (int, error) {
+	n, err := t.file.Read(p)
+	for err == nil && t.paused.Load() {
+		n, err = t.file.Read(p)
+	}
+	if err != nil {
+		// The endpoint stops reading on any error, so every read error
+		// ends the session, except the deadline set by detach.
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.fail(err)
+		}
+		return n, err
+	}
+	t.firstReadOnce.Do(func() { close(t.firstRead) })
+	throttle(t.ctx, n)
+	return n, nil
+}
+
+func (t *tunIO) Write(p []byte) (int, error) {
+	if t.paused.Load() {
+		return len(p), nil
+	}
+	throttle(t.ctx, len(p))
+	n, err := t.file.Write(p)
+	if err != nil && fdGone(err) {
+		t.fail(err)
+	}
+	return n, err
+}
+
+func (t *tunIO) fail(err error) {
+	if t.closed.Load() {
+		return
+	}
+	t.failOnce.Do(func() { t.onFail(err) })
+}
+
+// fdGone reports whether a write error means the fd itself is unusable,
+// as opposed to a single rejected packet.
+func fdGone(err error) bool {
+	return errors.Is(err, os.ErrClosed) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, unix.EBADF) ||
+		errors.Is(err, unix.EIO)
+}
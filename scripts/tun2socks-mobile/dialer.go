@@ -0,0 +1,313 @@
+package tun2socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+)
+
+// dispatcher is the dialer of a running session and decides, per new flow, whether to dial through the upstream proxy or
+// directly.
+type dispatcher struct {
+	upstream    proxy.Proxy
+	direct      proxy.Proxy
+	reject      proxy.Proxy
+	bypass      []*net.IPNet
+	block       []*net.IPNet
+	allow       []*net.IPNet
+	local       []net.IP
+	noUDP       bool
+	dialTimeout time.Duration
+
+	// dnsIP and dnsPort, when set, redirect every port 53 flow.
+	dnsIP   net.IP
+	dnsPort uint16
+
+	rules []domainRule
+
+	// fake, when set, answers DNS with fake addresses, and flows to them
+	// are dialed by name.
+	fake *fakePool
+
+	// health, when set, is told how dials through upstream went.
+	health *upstreamHealth
+
+	// ctx ends with the session, cancelling the dials still in flight.
+	ctx context.Context
+}
+
+var _ proxy.Dialer = (*dispatcher)(nil)
+
+// activeDispatcher is the dispatcher of the running session, set by
+// setUpstream. The engine reads its dialer without synchronization, so it
+// is set once, to engineDialer, and only this pointer changes.
+var activeDispatcher atomic.Pointer[dispatcher]
+
+func init() {
+	proxy.SetDialer(engineDialer{})
+}
+
+// engineDialer is the engine's dialer for good. It hands every flow to
+// activeDispatcher.
+type engineDialer struct{}
+
+var errNoSession = errors.New("not running")
+
+func (engineDialer) DialContext(ctx context.Context, metadata *M.Metadata) (net.Conn, error) {
+	d := activeDispatcher.Load()
+	if d == nil {
+		return nil, errNoSession
+	}
+	return d.DialContext(ctx, metadata)
+}
+
+func (engineDialer) DialUDP(metadata *M.Metadata) (net.PacketConn, error) {
+	d := activeDispatcher.Load()
+	if d == nil {
+		return nil, errNoSession
+	}
+	return d.DialUDP(metadata)
+}
+
+var (
+	errUDPDisabled = errors.New("udp disabled")
+	errBlocked     = errors.New("blocked by policy")
+)
+
+// defaultDialTimeout matches the engine's own TCP connect timeout.
+const defaultDialTimeout = 5 * time.Second
+
+// newDispatcher returns a dispatcher for upstream using the current
+// options. Callers must hold lifecycleMu.
+func newDispatcher(upstream proxy.Proxy) *dispatcher {
+	timeout := options.dialTimeout
+	if timeout == 0 {
+		timeout = defaultDialTimeout
+	}
+	d := &dispatcher{
+		upstream:    upstream,
+		direct:      newDirect(),
+		reject:      proxy.NewReject(),
+		bypass:      options.bypassCIDRs,
+		block:       options.blockCIDRs,
+		allow:       options.allowCIDRs,
+		local:       options.tunAddrs,
+		noUDP:       options.udpDisabled,
+		dialTimeout: timeout,
+		dnsIP:       options.dnsIP,
+		dnsPort:     options.dnsPort,
+		rules:       options.domainRules,
+		ctx:         context.Background(),
+	}
+	if options.fakeIPNet != nil {
+		d.fake = fakePoolFor(options.fakeIPNet)
+	}
+	return d
+}
+
+// DialContext bounds the whole dial, including the proxy handshake, by the
+// configured dial timeout instead of the engine's fixed connect timeout,
+// and by the session.
+func (d *dispatcher) DialContext(_ context.Context, metadata *M.Metadata) (net.Conn, error) {
+	if d.blocked(metadata.DstIP) {
+		return nil, errBlocked
+	}
+	ctx := d.ctx
+	if d.fake.contains(metadata.DstIP) {
+		name := d.fake.nameOf(metadata.DstIP)
+		if name == "" {
+			return nil, errFakeIPUnknown
+		}
+		ctx = withDestHost(ctx, name)
+	}
+	src, dst := metadata.SourceAddress(), destAddress(ctx, metadata)
+	if !filterAllows("tcp", src, dst) {
+		return nil, errFiltered
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.dialTimeout)
+	defer cancel()
+	p := d.route(metadata)
+	c, err := dialWithin(ctx, p, metadata)
+	if p == d.upstream {
+		d.recordUpstream(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := d.ctx.Err(); err != nil {
+		c.Close() /* the session stopped while dialing */
+		return nil, err
+	}
+	return trackConn(c, src, dst), nil
+}
+
+func (d *dispatcher) DialUDP(metadata *M.Metadata) (net.PacketConn, error) {
+	if d.noUDP {
+		return nil, errUDPDisabled
+	}
+	if d.blocked(metadata.DstIP) {
+		return nil, errBlocked
+	}
+	var host string
+	if d.fake.contains(metadata.DstIP) {
+		name := d.fake.nameOf(metadata.DstIP)
+		if name == "" {
+			return nil, errFakeIPUnknown
+		}
+		host = net.JoinHostPort(name, strconv.Itoa(int(metadata.DstPort)))
+	}
+	src, dst := metadata.SourceAddress(), metadata.DestinationAddress()
+	if host != "" {
+		dst = host
+	}
+	if !filterAllows("udp", src, dst) {
+		return nil, errFiltered
+	}
+	dns := metadata.DstPort == 53
+	if dns && d.fake != nil && host == "" {
+		return trackPacketConn(d.fakeDNS(metadata), src, dst), nil
+	}
+	p := d.route(metadata)
+	pc, err := d.dialUDP(p, metadata)
+	if p == d.upstream {
+		d.recordUpstream(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := d.ctx.Err(); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	if host != "" {
+		pc = &fakeIPPacketConn{PacketConn: pc, to: hostAddr(host), from: metadata.UDPAddr()}
+	} else if dns && len(d.rules) > 0 {
+		pc = &dnsSnoopConn{PacketConn: pc}
+	}
+	return trackPacketConn(pc, src, dst), nil
+}
+
+// fakeDNS returns the DNS flow to metadata answered by the fake-IP pool.
+// The queries it cannot answer are routed like a DNS flow without fake-IP,
+// on a copy of metadata so replies still come from the server asked.
+func (d *dispatcher) fakeDNS(metadata *M.Metadata) net.PacketConn {
+	return newFakeDNSConn(d.fake, metadata.UDPAddr(), func() (net.PacketConn, net.Addr, error) {
+		m := *metadata
+		p := d.route(&m)
+		pc, err := d.dialUDP(p, &m)
+		if p == d.upstream {
+			d.recordUpstream(err)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return pc, m.UDPAddr(), nil
+	})
+}
+
+// dialUDP dials a UDP flow through p, bounding its handshake, e.g. a
+// SOCKS5 UDP ASSOCIATE, by the dial timeout and the session.
+func (d *dispatcher) dialUDP(p proxy.Proxy, metadata *M.Metadata) (net.PacketConn, error) {
+	ctx, cancel := context.WithTimeout(d.ctx, d.dialTimeout)
+	defer cancel()
+	return dialUDPContext(ctx, p, metadata)
+}
+
+// recordUpstream accounts for a dial through the upstream proxy.
+func (d *dispatcher) recordUpstream(err error) {
+	if err != nil {
+		counters.dialFailures.Add(1)
+	}
+	d.health.record(err)
+}
+
+// blocked reports whether the block and allow lists forbid flows to ip.
+func (d *dispatcher) blocked(ip net.IP) bool {
+	if d.allow != nil && !containsIP(d.allow, ip) {
+		return true
+	}
+	return containsIP(d.block, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// route picks the proxy for a new flow. Flows to the TUN's own addresses
+// are rejected. DNS flows are redirected to the configured resolver and
+// always go through the upstream proxy. Domain rules come before the
+// bypass CIDRs.
+//
+// The redirect rewrites metadata in place: for UDP the engine takes the
+// reply address from the same metadata after dialing, and the app still
+// sees answers coming from the server it queried.
+func (d *dispatcher) route(metadata *M.Metadata) proxy.Proxy {
+	for _, ip := range d.local {
+		if ip.Equal(metadata.DstIP) {
+			return d.reject
+		}
+	}
+	if d.dnsIP != nil && metadata.DstPort == 53 {
+		metadata.DstIP, metadata.DstPort = d.dnsIP, d.dnsPort
+		return d.upstream
+	}
+	if len(d.rules) > 0 {
+		switch matchDomain(d.rules, d.domainOf(metadata.DstIP)) {
+		case actionDirect:
+			return d.direct
+		case actionProxy:
+			return d.upstream
+		}
+	}
+	if containsIP(d.bypass, metadata.DstIP) {
+		return d.direct
+	}
+	return d.upstream
+}
+
+// domainOf returns the name behind ip: the one it was handed out for if
+// it is a fake address, else the last one seen resolving to it.
+func (d *dispatcher) domainOf(ip net.IP) string {
+	if d.fake.contains(ip) {
+		return d.fake.nameOf(ip)
+	}
+	return domainOf(ip)
+}
+
+// dialWithin dials through p but returns once ctx is done, even when p is
+// stuck in a handshake that does not watch ctx (e.g. waiting for the HTTP
+// CONNECT response). A connection completing after that is closed.
+func dialWithin(ctx context.Context, p proxy.Dialer, metadata *M.Metadata) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := p.DialContext(ctx, metadata)
+		done <- result{c, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,221 @@
+package tun2socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+)
+
+func TestSetUDPEnabled(t *testing.T) {
+	defer SetUDPEnabled(true)
+
+	metadata := &M.Metadata{Network: M.UDP, DstIP: net.IPv4(1, 1, 1, 1), DstPort: 53}
+
+	SetUDPEnabled(false)
+	d := newDispatcher(proxy.NewReject())
+	if !d.noUDP {
+		t.Fatal("dispatcher has UDP enabled after SetUDPEnabled(false)")
+	}
+	if _, err := d.DialUDP(metadata); err != errUDPDisabled {
+		t.Errorf("DialUDP = %v, want %v", err, errUDPDisabled)
+	}
+
+	SetUDPEnabled(true)
+	d = newDispatcher(proxy.NewReject())
+	if d.noUDP {
+		t.Fatal("dispatcher has UDP disabled after SetUDPEnabled(true)")
+	}
+	if _, err := d.DialUDP(metadata); err == errUDPDisabled {
+		t.Error("DialUDP rejected as disabled after SetUDPEnabled(true)")
+	}
+}
+
+func TestDialTimeoutCoversHandshake(t *testing.T) {
+	defer func() { options.dialTimeout = 0 }()
+
+	// A proxy that accepts connections but never answers CONNECT.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	if err := SetDialTimeout(100); err != nil {
+		t.Fatal(err)
+	}
+	p, err := parseProxy("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDispatcher(p)
+
+	start := time.Now()
+	_, err = d.DialContext(context.Background(), &M.Metadata{Network: M.TCP, DstIP: net.IPv4(1, 1, 1, 1), DstPort: 443})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("DialContext = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("DialContext took %v, want about 100ms", elapsed)
+	}
+
+	// The same silent server as a SOCKS5 proxy never answers UDP ASSOCIATE.
+	p, err = parseProxy("socks5://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d = newDispatcher(p)
+
+	start = time.Now()
+	if _, err := d.DialUDP(&M.Metadata{Network: M.UDP, DstIP: net.IPv4(1, 1, 1, 1), DstPort: 443}); err == nil {
+		t.Error("DialUDP = nil error through a silent proxy")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("DialUDP took %v, want about 100ms", elapsed)
+	}
+}
+
+func TestSetDialTimeoutInvalid(t *testing.T) {
+	for _, ms := range []int{0, -1} {
+		if err := SetDialTimeout(ms); err == nil {
+			t.Errorf("SetDialTimeout(%d) = nil, want error", ms)
+		}
+	}
+}
+
+func TestSetDNSRedirectsPort53(t *testing.T) {
+	defer SetDNS("")
+
+	if err := SetDNS("1.1.1.1:5353"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetBypassCIDRs("9.9.9.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetBypassCIDRs("")
+
+	upstream := proxy.NewReject()
+	d := newDispatcher(upstream)
+
+	metadata := &M.Metadata{Network: M.UDP, DstIP: net.IPv4(9, 9, 9, 9), DstPort: 53}
+	if p := d.route(metadata); p != upstream {
+		t.Errorf("route(dns) = %v, want upstream", p.Proto())
+	}
+	if got := metadata.DestinationAddress(); got != "1.1.1.1:5353" {
+		t.Errorf("redirected to %s, want 1.1.1.1:5353", got)
+	}
+
+	metadata = &M.Metadata{Network: M.TCP, DstIP: net.IPv4(9, 9, 9, 9), DstPort: 443}
+	if p := d.route(metadata); p == upstream {
+		t.Error("route(bypassed) = upstream, want direct")
+	}
+}
+
+func TestSetDNSInvalid(t *testing.T) {
+	for _, addr := range []string{"1.1.1.1", "dns.google:53", "1.1.1.1:0"} {
+		if err := SetDNS(addr); err == nil {
+			t.Errorf("SetDNS(%q) = nil, want error", addr)
+		}
+	}
+}
+
+func TestBlockAndAllowCIDRs(t *testing.T) {
+	defer SetBlockCIDRs("")
+	defer SetAllowOnlyCIDRs("")
+
+	if err := SetAllowOnlyCIDRs("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetBlockCIDRs("10.1.0.0/16, 2001:db8::/32"); err != nil {
+		t.Fatal(err)
+	}
+	d := newDispatcher(proxy.NewDirect())
+
+	tests := []struct {
+		ip      net.IP
+		blocked bool
+	}{
+		{net.IPv4(10, 2, 3, 4), false},
+		{net.IPv4(10, 1, 3, 4), true},  // blocked within the allow list
+		{net.IPv4(192, 0, 2, 1), true}, // outside the allow list
+		{net.ParseIP("2001:db8::1"), true},
+	}
+	for _, tt := range tests {
+		metadata := &M.Metadata{Network: M.TCP, DstIP: tt.ip, DstPort: 443}
+		if tt.blocked {
+			if _, err := d.DialContext(context.Background(), metadata); err != errBlocked {
+				t.Errorf("DialContext(%v) = %v, want %v", tt.ip, err, errBlocked)
+			}
+			if _, err := d.DialUDP(metadata); err != errBlocked {
+				t.Errorf("DialUDP(%v) = %v, want %v", tt.ip, err, errBlocked)
+			}
+		} else if d.blocked(tt.ip) {
+			t.Errorf("blocked(%v) = true, want false", tt.ip)
+		}
+	}
+
+	if err := SetBlockCIDRs("10.0.0.0/33"); err == nil {
+		t.Error("SetBlockCIDRs(bad) = nil, want error")
+	}
+	if err := SetAllowOnlyCIDRs("nope"); err == nil {
+		t.Error("SetAllowOnlyCIDRs(bad) = nil, want error")
+	}
+}
+
+func TestBlockedFlowsRefused(t *testing.T) {
+	defer Stop()
+	defer SetBlockCIDRs("")
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[1])
+	if err := Start(fds[0], "direct://", "silent"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetBlockCIDRs("192.0.2.0/24"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The SYN is answered with a RST, so the app sees ECONNREFUSED.
+	app, blocked := [4]byte{10, 0, 0, 2}, [4]byte{192, 0, 2, 1}
+	unix.Write(fds[1], tcpPacket(app, blocked, 40000, 80, 1, 0, header.TCPFlagSyn))
+	unix.SetsockoptTimeval(fds[1], unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 5})
+	buf := make([]byte, 1500)
+	n, err := unix.Read(fds[1], buf)
+	if err != nil {
+		t.Fatalf("no reply to a blocked SYN: %v", err)
+	}
+	tcp := header.TCP(header.IPv4(buf[:n]).Payload())
+	if tcp.Flags()&header.TCPFlagRst == 0 || tcp.Flags()&header.TCPFlagSyn != 0 {
+		t.Errorf("reply to a blocked SYN has flags %v, want RST", tcp.Flags())
+	}
+
+	// Blocked UDP is dropped before the netstack opens a flow for it.
+	unix.Write(fds[1], udpPacket(app, blocked, 40001, 53, []byte("query")))
+	unix.Write(fds[1], udpPacket(app, [4]byte{198, 51, 100, 1}, 40002, 9, []byte("allowed")))
+	deadline := time.Now().Add(5 * time.Second)
+	for ConnectionCount().UDP == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := ConnectionCount().UDP; got != 1 {
+		t.Errorf("%d UDP flows, want only the allowed one", got)
+	}
+}
@@ -0,0 +1,201 @@
+package tun2socks
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+)
+
+// DNS leak check verdicts.
+const (
+	DNSLeakOK      = "ok"
+	DNSLeakLeak    = "leak"
+	DNSLeakUnknown = "unknown"
+)
+
+// The DNS leak check asks Google's whoami name, whose TXT answer is the
+// address the query reached Google's name server from, plus the client
+// subnet a resolver forwarded with it, if any. Vars for tests.
+var (
+	dnsLeakMarker    = "o-o.myaddr.l.google.com."
+	dnsLeakAuthority = "216.239.32.10:53" /* ns1.google.com */
+	dnsLeakResolver  = "8.8.8.8:53"
+)
+
+// CheckDNSLeak reports whether DNS queries from apps go through the proxy.
+// It sends a marker query the way an app's query to a public resolver
+// would travel through the running engine, after the SetDNS redirect,
+// domain rules and bypass CIDRs, and learns the address the resolver saw.
+// It compares that with the proxy's exit address, learned by asking the
+// marker's name server directly through the proxy. The result is a JSON
+// object:
+//
+//	{
+//	  "status": "ok",
+//	  "resolver": "1.1.1.1:53",
+//	  "resolverAddress": "172.68.1.2",
+//	  "clientSubnet": "203.0.113.0/24",
+//	  "exit": "203.0.113.7",
+//	  "detail": "DNS goes through the proxy"
+//	}
+//
+// status is "leak" when queries are routed around the proxy or the
+// resolver saw them come from a subnet other than the proxy exit's, "ok"
+// when they go through the proxy, and "unknown" when the check itself
+// failed; detail says why. Both queries use DNS over TCP, so proxies
+// without UDP support work too. An error is returned if the engine is not
+// running or the arguments are invalid.
+func CheckDNSLeak(timeoutMs int) (string, error) {
+	if timeoutMs <= 0 {
+		return "", fmt.Errorf("invalid timeout: %d", timeoutMs)
+	}
+	resolverIP, resolverPort, err := splitIPPort(dnsLeakResolver)
+	if err != nil {
+		return "", err
+	}
+	authorityIP, authorityPort, err := splitIPPort(dnsLeakAuthority)
+	if err != nil {
+		return "", err
+	}
+
+	lifecycleMu.Lock()
+	var d *dispatcher
+	if currentSession != nil {
+		d = currentSession.dispatcher
+	}
+	lifecycleMu.Unlock()
+	if d == nil {
+		return "", errors.New("not running")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	metadata := &M.Metadata{Network: M.TCP, DstIP: resolverIP, DstPort: resolverPort}
+	p := d.route(metadata) /* applies the DNS redirect to metadata */
+	r := &dnsLeakResult{Resolver: metadata.DestinationAddress()}
+	if d.blocked(metadata.DstIP) {
+		r.Status, r.Detail = DNSLeakUnknown, fmt.Sprintf("DNS to %s is blocked", r.Resolver)
+		return r.json(), nil
+	}
+	if p == d.reject {
+		r.Status, r.Detail = DNSLeakUnknown, fmt.Sprintf("DNS to %s is rejected", r.Resolver)
+		return r.json(), nil
+	}
+
+	exit, _, exitErr := whoami(ctx, d.upstream, &M.Metadata{Network: M.TCP, DstIP: authorityIP, DstPort: authorityPort})
+	r.Exit = exit
+	seen, subnet, err := whoami(ctx, p, metadata)
+	r.ResolverAddress, r.ClientSubnet = seen, subnet
+
+	switch {
+	case p != d.upstream:
+		r.Status, r.Detail = DNSLeakLeak, fmt.Sprintf("DNS to %s is routed around the proxy", r.Resolver)
+	case err != nil:
+		r.Status, r.Detail = DNSLeakUnknown, fmt.Sprintf("query through the proxy: %v", err)
+	case subnet != "" && exit != "":
+		_, n, _ := net.ParseCIDR(subnet)
+		if n != nil && n.Contains(net.ParseIP(exit)) {
+			r.Status, r.Detail = DNSLeakOK, "DNS goes through the proxy"
+		} else {
+			r.Status, r.Detail = DNSLeakLeak, fmt.Sprintf("resolver saw the query from %s, not the proxy exit %s", subnet, exit)
+		}
+	case exitErr != nil:
+		r.Status, r.Detail = DNSLeakOK, fmt.Sprintf("DNS goes through the proxy; exit unknown: %v", exitErr)
+	default:
+		r.Status, r.Detail = DNSLeakOK, "DNS goes through the proxy"
+	}
+	return r.json(), nil
+}
+
+// dnsLeakResult is the JSON form of the CheckDNSLeak result.
+type dnsLeakResult struct {
+	Status          string `json:"status"`
+	Resolver        string `json:"resolver"`
+	ResolverAddress string `json:"resolverAddress,omitempty"`
+	ClientSubnet    string `json:"clientSubnet,omitempty"`
+	Exit            string `json:"exit,omitempty"`
+	Detail          string `json:"detail"`
+}
+
+func (r *dnsLeakResult) json() string {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+// whoami asks for the marker's TXT record over DNS over TCP to metadata
+// through p. It returns the address the name server saw the query from
+// and the client subnet forwarded with it, if any.
+func whoami(ctx context.Context, p proxy.Proxy, metadata *M.Metadata) (addr, subnet string, err error) {
+	name, err := dnsmessage.NewName(dnsLeakMarker)
+	if err != nil {
+		return "", "", err
+	}
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(time.Now().UnixNano()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return "", "", err
+	}
+
+	c, err := dialWithin(ctx, p, metadata)
+	if err != nil {
+		return "", "", err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := c.Write(msg); err != nil {
+		return "", "", err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(c, size[:]); err != nil {
+		return "", "", err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(c, resp); err != nil {
+		return "", "", err
+	}
+
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		return "", "", fmt.Errorf("bad DNS response: %w", err)
+	}
+	for _, a := range m.Answers {
+		txt, ok := a.Body.(*dnsmessage.TXTResource)
+		if !ok {
+			continue
+		}
+		for _, s := range txt.TXT {
+			if rest, ok := strings.CutPrefix(s, "edns0-client-subnet "); ok {
+				subnet = rest
+			} else if net.ParseIP(s) != nil {
+				addr = s
+			}
+		}
+	}
+	if addr == "" {
+		return "", "", fmt.Errorf("no whoami answer from %s", metadata.DestinationAddress())
+	}
+	return addr, subnet, nil
+}
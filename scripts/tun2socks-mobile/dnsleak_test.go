@@ -0,0 +1,121 @@
+package tun2socks
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// whoamiServer serves the DNS leak marker over TCP, answering with the
+// client address and, when set, a client subnet.
+func whoamiServer(t *testing.T, subnet string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				var size [2]byte
+				if _, err := io.ReadFull(c, size[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(size[:]))
+				if _, err := io.ReadFull(c, query); err != nil {
+					return
+				}
+				var m dnsmessage.Message
+				if err := m.Unpack(query); err != nil {
+					return
+				}
+				txt := []string{c.RemoteAddr().(*net.TCPAddr).IP.String()}
+				if subnet != "" {
+					txt = append(txt, "edns0-client-subnet "+subnet)
+				}
+				m.Header.Response = true
+				m.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: m.Questions[0].Name, Class: dnsmessage.ClassINET},
+					Body:   &dnsmessage.TXTResource{TXT: txt},
+				}}
+				resp, err := m.Pack()
+				if err != nil {
+					return
+				}
+				binary.BigEndian.PutUint16(size[:], uint16(len(resp)))
+				c.Write(append(size[:], resp...))
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestCheckDNSLeak(t *testing.T) {
+	defer func(a, r string) { dnsLeakAuthority, dnsLeakResolver = a, r }(dnsLeakAuthority, dnsLeakResolver)
+	defer Stop()
+	defer SetBypassCIDRs("")
+
+	if _, err := CheckDNSLeak(1000); err == nil {
+		t.Error("CheckDNSLeak = nil error when not running")
+	}
+
+	dnsLeakAuthority = whoamiServer(t, "")
+	tests := []struct {
+		name, subnet, bypass string
+		want                 string
+	}{
+		{"through proxy", "", "", DNSLeakOK},
+		{"exit subnet", "127.0.0.0/24", "", DNSLeakOK},
+		{"other subnet", "198.51.100.0/24", "", DNSLeakLeak},
+		{"bypassed", "", "127.0.0.0/8", DNSLeakLeak},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer Stop()
+			dnsLeakResolver = whoamiServer(t, tt.subnet)
+			if err := SetBypassCIDRs(tt.bypass); err != nil {
+				t.Fatal(err)
+			}
+			if err := Start(testTunFd(t), "direct://", "silent"); err != nil {
+				t.Fatal(err)
+			}
+			out, err := CheckDNSLeak(2000)
+			if err != nil {
+				t.Fatalf("CheckDNSLeak = %v", err)
+			}
+			var r dnsLeakResult
+			if err := json.Unmarshal([]byte(out), &r); err != nil {
+				t.Fatal(err)
+			}
+			if r.Status != tt.want || r.Resolver != dnsLeakResolver || r.ResolverAddress != "127.0.0.1" {
+				t.Errorf("CheckDNSLeak() = %s, want status %q", out, tt.want)
+			}
+		})
+	}
+
+	dnsLeakResolver = deadAddr(t)
+	if err := SetBypassCIDRs(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := Start(testTunFd(t), "direct://", "silent"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := CheckDNSLeak(2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r dnsLeakResult
+	if err := json.Unmarshal([]byte(out), &r); err != nil || r.Status != DNSLeakUnknown {
+		t.Errorf("CheckDNSLeak() = %s with no resolver, want unknown", out)
+	}
+}
@@ -0,0 +1,375 @@
+package tun2socks
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/transport/socks5"
+)
+
+const (
+	// defaultFakeIPRange is the pool SetFakeIP uses when given no CIDR:
+	// the benchmarking range of RFC 2544, which no real host uses.
+	defaultFakeIPRange = "198.18.0.0/15"
+
+	// maxFakeIPPrefix is the longest pool prefix, i.e. at least 256
+	// addresses, so busy apps do not recycle addresses still in use.
+	maxFakeIPPrefix = 24
+
+	// fakeIPTTL is the TTL of fake answers, in seconds. Apps should ask
+	// again rather than keep an address the pool may have reused.
+	fakeIPTTL = 1
+)
+
+// fakeIPRanges are the ranges a fake-IP pool may come from: private,
+// shared (CGNAT) and benchmarking addresses, none of them routable on the
+// internet.
+var fakeIPRanges, _ = parseCIDRs("10.0.0.0/8, 100.64.0.0/10, 172.16.0.0/12, 192.168.0.0/16, 198.18.0.0/15")
+
+var errFakeIPUnknown = errors.New("unknown fake ip")
+
+// SetFakeIP turns fake-IP DNS on or off. When on, every plain DNS query
+// (UDP port 53) is answered by the engine itself: an A query gets a
+// synthetic address from cidr, e.g. "198.18.0.0/15" (the default when
+// cidr is empty), and an AAAA query an empty answer, so apps connect over
+// IPv4 to fake addresses. A connection to a fake address is sent to the
+// proxy by name, so the real lookup happens at the proxy, at connect time,
+// and no DNS round trip delays it. Set before Start.
+//
+// cidr must be an IPv4 range of at least 256 addresses within 10.0.0.0/8,
+// 100.64.0.0/10, 172.16.0.0/12, 192.168.0.0/16 or 198.18.0.0/15, and must
+// not overlap the networks the device really uses. It is ignored when
+// disabling.
+//
+// Other query types (MX, TXT, ...) still go to a real resolver, the
+// SetDNS one if set; A and AAAA queries never reach it. Domain rules match
+// the exact name behind a fake address, so they work even for names the
+// tunnel never saw resolved in plain DNS; "direct" flows resolve the name
+// on the device. Bypass CIDRs cannot apply to fake addresses, and the
+// block and allow lists see the fake address: add the fake range to an
+// allow list. DNS over TCP, DoH and DoT are not answered and return real
+// addresses, which keep working as without fake-IP.
+func SetFakeIP(enabled bool, cidr string) error {
+	var n *net.IPNet
+	if enabled {
+		var err error
+		if n, err = parseFakeIPRange(cidr); err != nil {
+			return err
+		}
+	}
+
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	options.fakeIPNet = n
+	return nil
+}
+
+func parseFakeIPRange(cidr string) (*net.IPNet, error) {
+	if cidr == "" {
+		cidr = defaultFakeIPRange
+	}
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fake ip range %q", cidr)
+	}
+	ones, bits := n.Mask.Size()
+	if n.IP.To4() == nil || bits != 32 {
+		return nil, fmt.Errorf("invalid fake ip range %q: must be IPv4", cidr)
+	}
+	if ones > maxFakeIPPrefix {
+		return nil, fmt.Errorf("invalid fake ip range %q: must be /%d or larger", cidr, maxFakeIPPrefix)
+	}
+	for _, r := range fakeIPRanges {
+		if rOnes, _ := r.Mask.Size(); rOnes <= ones && r.Contains(n.IP) {
+			return n, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid fake ip range %q: not within a private or reserved range", cidr)
+}
+
+// fakePool hands out fake addresses for names, reusing the oldest once
+// the range is exhausted.
+type fakePool struct {
+	net        *net.IPNet
+	base, size uint32
+
+	mu    sync.Mutex
+	next  uint32
+	names map[uint32]string
+	ips   map[string]uint32
+}
+
+// fakeIPs is the pool of the configured range, kept across sessions so
+// addresses apps still hold stay valid. Guarded by lifecycleMu.
+var fakeIPs *fakePool
+
+// fakePoolFor returns the pool for n. Callers must hold lifecycleMu.
+func fakePoolFor(n *net.IPNet) *fakePool {
+	if fakeIPs == nil || fakeIPs.net.String() != n.String() {
+		fakeIPs = newFakePool(n)
+	}
+	return fakeIPs
+}
+
+func newFakePool(n *net.IPNet) *fakePool {
+	ones, _ := n.Mask.Size()
+	return &fakePool{
+		net:   n,
+		base:  binary.BigEndian.Uint32(n.IP.To4()),
+		size:  1 << (32 - ones),
+		names: map[uint32]string{},
+		ips:   map[string]uint32{},
+	}
+}
+
+func (p *fakePool) contains(ip net.IP) bool {
+	return p != nil && p.net.Contains(ip)
+}
+
+// ipFor returns the fake address of name, allocating one if needed. The
+// network and broadcast addresses are never handed out.
+func (p *fakePool) ipFor(name string) net.IP {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	off, ok := p.ips[name]
+	if !ok {
+		p.next = p.next%(p.size-2) + 1
+		off = p.next
+		if old, used := p.names[off]; used {
+			delete(p.ips, old)
+		}
+		p.names[off], p.ips[name] = name, off
+	}
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, p.base+off)
+	return ip
+}
+
+// nameOf returns the name behind a fake address, or "".
+func (p *fakePool) nameOf(ip net.IP) string {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return ""
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.names[binary.BigEndian.Uint32(ip4)-p.base]
+}
+
+// answer returns the fake answer to an A or AAAA query, or false for
+// queries a real resolver must answer.
+func (p *fakePool) answer(query []byte) ([]byte, bool) {
+	var m dnsmessage.Message
+	if err := m.Unpack(query); err != nil || m.Header.Response || len(m.Questions) != 1 {
+		return nil, false
+	}
+	q := m.Questions[0]
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	if q.Class != dnsmessage.ClassINET || (q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA) || name == "" {
+		return nil, false
+	}
+
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 m.Header.ID,
+			Response:           true,
+			RecursionDesired:   m.Header.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: m.Questions,
+	}
+	if q.Type == dnsmessage.TypeA {
+		var a dnsmessage.AResource
+		copy(a.A[:], p.ipFor(name))
+		resp.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: fakeIPTTL},
+			Body:   &a,
+		}}
+	}
+	packed, err := resp.Pack()
+	if err != nil {
+		return nil, false
+	}
+	return packed, true
+}
+
+type destHostKey struct{}
+
+// withDestHost makes the proxies ask for host instead of the IP of the
+// metadata they dial, for a flow to a fake address.
+func withDestHost(ctx context.Context, host string) context.Context {
+	return context.WithValue(ctx, destHostKey{}, host)
+}
+
+// destAddress returns the "host:port" a proxy dials for metadata.
+func destAddress(ctx context.Context, metadata *M.Metadata) string {
+	if host, ok := ctx.Value(destHostKey{}).(string); ok {
+		return net.JoinHostPort(host, fmt.Sprint(metadata.DstPort))
+	}
+	return metadata.DestinationAddress()
+}
+
+// destSocksAddr is destAddress in SOCKS form.
+func destSocksAddr(ctx context.Context, metadata *M.Metadata) socks5.Addr {
+	if host, ok := ctx.Value(destHostKey{}).(string); ok {
+		return socks5.SerializeAddr(host, nil, metadata.DstPort)
+	}
+	return serializeSocksAddr(metadata)
+}
+
+// hostAddr is a "host:port" packet destination, which the proxies send by
+// name.
+type hostAddr string
+
+func (a hostAddr) Network() string { return "udp" }
+func (a hostAddr) String() string  { return string(a) }
+
+// fakeIPPacketConn is a UDP flow to a fake address: it sends to the name
+// behind it and reports replies as coming from the fake address.
+type fakeIPPacketConn struct {
+	net.PacketConn
+	to   hostAddr
+	from net.Addr
+}
+
+func (c *fakeIPPacketConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return c.PacketConn.WriteTo(b, c.to)
+}
+
+func (c *fakeIPPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, _, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, nil, err
+	}
+	return n, c.from, nil
+}
+
+// fakeDNSConn is a DNS flow answered by the fake-IP pool. Other queries
+// are forwarded through forward, dialed on first use, and their replies
+// passed back as if from the server the app asked.
+type fakeDNSConn struct {
+	pool    *fakePool
+	from    net.Addr
+	forward func() (net.PacketConn, net.Addr, error)
+
+	replies   chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time
+	fwd      net.PacketConn
+	fwdTo    net.Addr
+}
+
+func newFakeDNSConn(pool *fakePool, from net.Addr, forward func() (net.PacketConn, net.Addr, error)) *fakeDNSConn {
+	return &fakeDNSConn{
+		pool:    pool,
+		from:    from,
+		forward: forward,
+		replies: make(chan []byte, 16),
+		done:    make(chan struct{}),
+	}
+}
+
+func (c *fakeDNSConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	if resp, ok := c.pool.answer(b); ok {
+		c.reply(resp)
+		return len(b), nil
+	}
+
+	c.mu.Lock()
+	if c.fwd == nil {
+		pc, to, err := c.forward()
+		if err != nil {
+			c.mu.Unlock()
+			return 0, err
+		}
+		c.fwd, c.fwdTo = pc, to
+		go c.readForwarded(pc)
+	}
+	fwd, to := c.fwd, c.fwdTo
+	c.mu.Unlock()
+	return fwd.WriteTo(b, to)
+}
+
+func (c *fakeDNSConn) readForwarded(pc net.PacketConn) {
+	buf := make([]byte, 64<<10)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		c.reply(append([]byte(nil), buf[:n]...))
+	}
+}
+
+func (c *fakeDNSConn) reply(msg []byte) {
+	select {
+	case c.replies <- msg:
+	case <-c.done:
+	default: /* app not reading, drop like the network would */
+	}
+}
+
+func (c *fakeDNSConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case msg := <-c.replies:
+		return copy(b, msg), c.from, nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *fakeDNSConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fwd != nil {
+		return c.fwd.Close()
+	}
+	return nil
+}
+
+func (c *fakeDNSConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4zero}
+}
+
+func (c *fakeDNSConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *fakeDNSConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *fakeDNSConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
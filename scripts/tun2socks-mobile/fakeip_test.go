@@ -0,0 +1,142 @@
+package tun2socks
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+)
+
+func TestSetFakeIPInvalid(t *testing.T) {
+	defer SetFakeIP(false, "")
+
+	for _, cidr := range []string{"198.18.0.0", "fd00::/8", "198.18.0.0/25", "8.8.8.0/24", "0.0.0.0/0", "10.0.0.0/7"} {
+		if err := SetFakeIP(true, cidr); err == nil {
+			t.Errorf("SetFakeIP(true, %q) = nil, want error", cidr)
+		}
+	}
+	for _, cidr := range []string{"", "198.18.0.0/15", "10.255.0.0/16", "100.64.0.0/24"} {
+		if err := SetFakeIP(true, cidr); err != nil {
+			t.Errorf("SetFakeIP(true, %q) = %v", cidr, err)
+		}
+	}
+	if err := SetFakeIP(false, "bogus"); err != nil {
+		t.Errorf("SetFakeIP(false, bogus) = %v, want nil", err)
+	}
+}
+
+func TestFakePoolReuse(t *testing.T) {
+	_, n, _ := net.ParseCIDR("10.1.2.0/24")
+	p := newFakePool(n)
+
+	first := p.ipFor("a.test")
+	if !first.Equal(net.IPv4(10, 1, 2, 1)) {
+		t.Errorf("ipFor(a.test) = %v, want 10.1.2.1", first)
+	}
+	if ip := p.ipFor("a.test"); !ip.Equal(first) {
+		t.Errorf("ipFor(a.test) again = %v, want %v", ip, first)
+	}
+	for i := 0; i < 253; i++ {
+		ip := p.ipFor(string(rune('a'+i%26)) + string(rune('a'+i/26)) + ".other")
+		if ip[3] == 0 || ip[3] == 255 {
+			t.Fatalf("handed out %v", ip)
+		}
+	}
+	if ip := p.ipFor("b.test"); !ip.Equal(first) {
+		t.Errorf("ipFor(b.test) on a full pool = %v, want reused %v", ip, first)
+	}
+	if got := p.nameOf(first); got != "b.test" {
+		t.Errorf("nameOf(%v) = %q, want b.test", first, got)
+	}
+}
+
+func TestFakeIPDNSAndDial(t *testing.T) {
+	if err := SetFakeIP(true, "198.18.0.0/15"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetFakeIP(false, "")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+
+	d := newDispatcher(newDirect())
+	server := net.IPv4(9, 9, 9, 9)
+	pc, err := d.DialUDP(&M.Metadata{Network: M.UDP, DstIP: server, DstPort: 53})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	fake := fakeLookup(t, pc, "localhost.", dnsmessage.TypeA)
+	if !fake.Is4() || !d.fake.contains(net.IP(fake.AsSlice())) {
+		t.Fatalf("A answer %v not in the fake range", fake)
+	}
+	if aaaa := fakeLookup(t, pc, "localhost.", dnsmessage.TypeAAAA); aaaa.IsValid() {
+		t.Errorf("AAAA answer %v, want none", aaaa)
+	}
+
+	fakeIP := net.IP(fake.AsSlice())
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+	c, err := d.DialContext(context.Background(), &M.Metadata{Network: M.TCP, DstIP: fakeIP, DstPort: port})
+	if err != nil {
+		t.Fatalf("DialContext(%v) = %v, want dialed by name", fakeIP, err)
+	}
+	c.Close()
+
+	unknown := net.IPv4(198, 19, 255, 1)
+	if _, err := d.DialContext(context.Background(), &M.Metadata{Network: M.TCP, DstIP: unknown, DstPort: port}); err != errFakeIPUnknown {
+		t.Errorf("DialContext(unknown fake) = %v, want %v", err, errFakeIPUnknown)
+	}
+}
+
+// fakeLookup sends a query over pc and returns the address answered, or
+// the zero Addr for an empty answer.
+func fakeLookup(t *testing.T, pc net.PacketConn, name string, qtype dnsmessage.Type) (ip netip.Addr) {
+	t.Helper()
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 7, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &net.UDPAddr{IP: net.IPv4(9, 9, 9, 9), Port: 53}
+	if _, err := pc.WriteTo(query, server); err != nil {
+		t.Fatal(err)
+	}
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 512)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.String() != server.String() {
+		t.Errorf("answer from %v, want %v", from, server)
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if m.Header.ID != 7 || !m.Header.Response {
+		t.Errorf("answer header %+v", m.Header)
+	}
+	for _, a := range m.Answers {
+		if r, ok := a.Body.(*dnsmessage.AResource); ok {
+			return netip.AddrFrom4(r.A)
+		}
+	}
+	return ip
+}
@@ -0,0 +1,68 @@
+package tun2socks
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/log"
+)
+
+// connFilterTimeout is how long a new flow waits for the connection
+// filter before it is allowed anyway.
+const connFilterTimeout = 50 * time.Millisecond
+
+var errFiltered = errors.New("denied by connection filter")
+
+// ConnectionFilter decides whether a new flow may go out, e.g. for a
+// firewall prompt. proto is "tcp" or "udp"; the addresses are "host:port"
+// as seen by the app, before any DNS redirect.
+type ConnectionFilter interface {
+	// Allow returns false to refuse the flow.
+	Allow(proto, srcAddr, dstAddr string) bool
+}
+
+type connFilterHolder struct{ f ConnectionFilter }
+
+var connFilter atomic.Pointer[connFilterHolder]
+
+// SetConnectionFilter makes every new flow wait for f to allow it before
+// it is proxied; nil removes the filter. It may be called before or after
+// Start and applies to new flows. Flows already blocked by SetBlockCIDRs
+// or SetAllowOnlyCIDRs do not reach f. A TCP connection f refuses is
+// closed as soon as the app opens it, since f is asked only once the
+// netstack has accepted it.
+//
+// f is called synchronously for each flow, on the engine's goroutine for
+// it, so its time adds to every connection setup. If it has not answered
+// within 50ms the flow is allowed and its answer ignored; a call that
+// never returns keeps a goroutine alive. Keep Allow fast, e.g. a lookup
+// in a table the UI fills in asynchronously, and set no filter when none
+// is needed: flows then skip the check entirely.
+func SetConnectionFilter(f ConnectionFilter) {
+	if f == nil {
+		connFilter.Store(nil)
+		return
+	}
+	connFilter.Store(&connFilterHolder{f: f})
+}
+
+// filterAllows asks the connection filter, if any, about a new flow.
+func filterAllows(proto, src, dst string) bool {
+	h := connFilter.Load()
+	if h == nil {
+		return true
+	}
+	verdict := make(chan bool, 1)
+	go func() { verdict <- h.f.Allow(proto, src, dst) }()
+
+	timer := time.NewTimer(connFilterTimeout)
+	defer timer.Stop()
+	select {
+	case ok := <-verdict:
+		return ok
+	case <-timer.C:
+		log.Debugf("[FILTER] no verdict for %s %s => %s within %v, allowing", proto, src, dst, connFilterTimeout)
+		return true
+	}
+}
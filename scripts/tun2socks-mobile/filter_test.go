@@ -0,0 +1,82 @@
+package tun2socks
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+)
+
+type filterFunc func(proto, src, dst string) bool
+
+func (f filterFunc) Allow(proto, src, dst string) bool { return f(proto, src, dst) }
+
+func TestConnectionFilter(t *testing.T) {
+	defer SetConnectionFilter(nil)
+
+	var (
+		mu    sync.Mutex
+		calls []string
+	)
+	SetConnectionFilter(filterFunc(func(proto, src, dst string) bool {
+		mu.Lock()
+		calls = append(calls, proto+" "+src+" "+dst)
+		mu.Unlock()
+		return dst != "192.0.2.1:443"
+	}))
+	d := newDispatcher(proxy.NewReject())
+	metadata := func(port uint16) *M.Metadata {
+		return &M.Metadata{Network: M.TCP, SrcIP: net.IPv4(10, 0, 0, 2), SrcPort: 40000, DstIP: net.IPv4(192, 0, 2, 1), DstPort: port}
+	}
+
+	if _, err := d.DialContext(context.Background(), metadata(443)); err != errFiltered {
+		t.Errorf("DialContext(denied) = %v, want %v", err, errFiltered)
+	}
+	if _, err := d.DialUDP(metadata(443)); err != errFiltered {
+		t.Errorf("DialUDP(denied) = %v, want %v", err, errFiltered)
+	}
+	if c, err := d.DialContext(context.Background(), metadata(80)); err == errFiltered {
+		t.Errorf("DialContext(allowed) = %v", err)
+	} else if err == nil {
+		c.Close()
+	}
+	want := []string{
+		"tcp 10.0.0.2:40000 192.0.2.1:443",
+		"udp 10.0.0.2:40000 192.0.2.1:443",
+		"tcp 10.0.0.2:40000 192.0.2.1:80",
+	}
+	mu.Lock()
+	if len(calls) != len(want) {
+		t.Errorf("filter calls = %q, want %q", calls, want)
+	}
+	for i := range want {
+		if i < len(calls) && calls[i] != want[i] {
+			t.Errorf("filter call %d = %q, want %q", i, calls[i], want[i])
+		}
+	}
+	mu.Unlock()
+
+	// A filter that does not answer in time allows the flow.
+	release := make(chan struct{})
+	defer close(release)
+	SetConnectionFilter(filterFunc(func(proto, src, dst string) bool {
+		<-release
+		return false
+	}))
+	start := time.Now()
+	if _, err := d.DialUDP(metadata(443)); err == errFiltered {
+		t.Errorf("DialUDP with a stuck filter = %v, want the flow allowed", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("DialUDP waited %v for a stuck filter", elapsed)
+	}
+
+	SetConnectionFilter(nil)
+	if !filterAllows("tcp", "a", "b") {
+		t.Error("filterAllows = false with no filter")
+	}
+}
@@ -0,0 +1,132 @@
+package tun2socks
+
+import (
+	"net"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+
+	"github.com/xjasonlyu/tun2socks/v2/core/adapter"
+	"github.com/xjasonlyu/tun2socks/v2/core/option"
+)
+
+// The engine's netstack completes the TCP handshake before the tunnel
+// sees a connection, so a blocked one could only be closed after the app
+// saw it open. The forwarders below take over from the engine's to refuse
+// blocked TCP connections with a RST and drop blocked UDP packets before
+// the netstack accepts anything; the rest they hand to the engine as its
+// own do.
+
+// As in the engine's core package.
+const (
+	tcpMaxConnAttempts   = 2 << 10
+	tcpKeepaliveCount    = 9
+	tcpKeepaliveIdle     = 60 * time.Second
+	tcpKeepaliveInterval = 30 * time.Second
+)
+
+// stackEndpoint is the link endpoint a session gives the netstack. The
+// netstack attaches it right after the engine installed its transport
+// handlers and before reading the first packet, so Attach swaps in the
+// forwarders then, with no packet in flight.
+type stackEndpoint struct {
+	*tunDevice
+	handler adapter.TransportHandler
+
+	// stack is set by the option of withStack and cleared once the
+	// forwarders are in.
+	stack *stack.Stack
+}
+
+// withStack records the stack being built in e.
+func (e *stackEndpoint) withStack() option.Option {
+	return func(s *stack.Stack) error {
+		e.stack = s
+		return nil
+	}
+}
+
+func (e *stackEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	if s := e.stack; dispatcher != nil && s != nil {
+		s.SetTransportProtocolHandler(tcp.ProtocolNumber, newTCPForwarder(s, e.handler.HandleTCP).HandlePacket)
+		s.SetTransportProtocolHandler(udp.ProtocolNumber, newUDPForwarder(s, e.handler.HandleUDP).HandlePacket)
+		e.stack = nil
+	}
+	e.tunDevice.Attach(dispatcher)
+}
+
+// flowBlocked reports whether the running session blocks flows to the
+// local address of id, i.e. the app's destination.
+func flowBlocked(id stack.TransportEndpointID) bool {
+	d := activeDispatcher.Load()
+	return d != nil && d.blocked(net.IP(id.LocalAddress.AsSlice()))
+}
+
+func newTCPForwarder(s *stack.Stack, handle func(adapter.TCPConn)) *tcp.Forwarder {
+	return tcp.NewForwarder(s, 0, tcpMaxConnAttempts, func(r *tcp.ForwarderRequest) {
+		id := r.ID()
+		if flowBlocked(id) {
+			r.Complete(true) /* RST: the app sees the connection refused */
+			return
+		}
+
+		var wq waiter.Queue
+		ep, err := r.CreateEndpoint(&wq)
+		if err != nil {
+			// RST: prevent potential half-open TCP connection leak.
+			r.Complete(true)
+			return
+		}
+		defer r.Complete(false)
+
+		// Buffer sizes come from the stack options the endpoint was
+		// created with.
+		ep.SocketOptions().SetKeepAlive(true)
+		idle := tcpip.KeepaliveIdleOption(tcpKeepaliveIdle)
+		ep.SetSockOpt(&idle)
+		interval := tcpip.KeepaliveIntervalOption(tcpKeepaliveInterval)
+		ep.SetSockOpt(&interval)
+		ep.SetSockOptInt(tcpip.KeepaliveCountOption, tcpKeepaliveCount)
+
+		handle(&forwardedTCPConn{TCPConn: gonet.NewTCPConn(&wq, ep), id: id})
+	})
+}
+
+func newUDPForwarder(s *stack.Stack, handle func(adapter.UDPConn)) *udp.Forwarder {
+	return udp.NewForwarder(s, func(r *udp.ForwarderRequest) {
+		id := r.ID()
+		if flowBlocked(id) {
+			return /* the packet is dropped */
+		}
+
+		var wq waiter.Queue
+		ep, err := r.CreateEndpoint(&wq)
+		if err != nil {
+			return
+		}
+		handle(&forwardedUDPConn{UDPConn: gonet.NewUDPConn(s, &wq, ep), id: id})
+	})
+}
+
+type forwardedTCPConn struct {
+	*gonet.TCPConn
+	id stack.TransportEndpointID
+}
+
+func (c *forwardedTCPConn) ID() *stack.TransportEndpointID {
+	return &c.id
+}
+
+type forwardedUDPConn struct {
+	*gonet.UDPConn
+	id stack.TransportEndpointID
+}
+
+func (c *forwardedUDPConn) ID() *stack.TransportEndpointID {
+	return &c.id
+}
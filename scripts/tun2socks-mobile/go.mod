@@ -2,12 +2,18 @@ module tun2socks
 
 go 1.26
 
-require github.com/xjasonlyu/tun2socks/v2 v2.5.2
+require (
+	github.com/Dreamacro/go-shadowsocks2 v0.1.8
+	github.com/docker/go-units v0.5.0
+	github.com/xjasonlyu/tun2socks/v2 v2.5.2
+	golang.org/x/net v0.10.0
+	golang.org/x/sys v0.8.0
+	golang.org/x/time v0.3.0
+	gvisor.dev/gvisor v0.0.0-20230603040744-5c9219dedd33
+)
 
 require (
-	github.com/Dreamacro/go-shadowsocks2 v0.1.8 // indirect
 	github.com/ajg/form v1.5.1 // indirect
-	github.com/docker/go-units v0.5.0 // indirect
 	github.com/go-chi/chi/v5 v5.0.8 // indirect
 	github.com/go-chi/cors v1.2.1 // indirect
 	github.com/go-chi/render v1.0.2 // indirect
@@ -17,10 +23,6 @@ require (
 	github.com/sirupsen/logrus v1.9.3 // indirect
 	go.uber.org/atomic v1.11.0 // indirect
 	golang.org/x/crypto v0.9.0 // indirect
-	golang.org/x/net v0.10.0 // indirect
-	golang.org/x/sys v0.8.0 // indirect
-	golang.org/x/time v0.3.0 // indirect
 	golang.zx2c4.com/wintun v0.0.0-20230126152724-0fa3db229ce2 // indirect
 	golang.zx2c4.com/wireguard v0.0.0-20230325221338-052af4a8072b // indirect
-	gvisor.dev/gvisor v0.0.0-20230603040744-5c9219dedd33 // indirect
 )
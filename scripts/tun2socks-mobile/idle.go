@@ -0,0 +1,119 @@
+package tun2socks
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/log"
+)
+
+// idleCheckInterval is how often the idle watcher samples the counters.
+const idleCheckInterval = time.Second
+
+// SetIdleTimeout stops the engine by itself after seconds without any
+// traffic in either direction, to save battery. 0 disables it, which is
+// the default. The state listener sees the usual "stopping" and "stopped".
+//
+// Any byte moved resets the idle clock, so the engine is never stopped
+// while a connection is transferring. The value is applied live when the
+// engine is running; the idle clock then starts over.
+func SetIdleTimeout(seconds int) error {
+	if seconds < 0 {
+		return fmt.Errorf("invalid idle timeout: %d", seconds)
+	}
+
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	options.idleTimeout = time.Duration(seconds) * time.Second
+	if s := currentSession; s != nil {
+		s.stopIdleWatch()
+		s.startIdleWatch()
+	}
+	return nil
+}
+
+// idleWatcher tracks when the byte counters last moved.
+type idleWatcher struct {
+	timeout time.Duration
+	now     func() time.Time
+	traffic func() int64
+
+	last       int64
+	lastActive time.Time
+}
+
+func newIdleWatcher(timeout time.Duration, now func() time.Time, traffic func() int64) *idleWatcher {
+	return &idleWatcher{
+		timeout:    timeout,
+		now:        now,
+		traffic:    traffic,
+		last:       traffic(),
+		lastActive: now(),
+	}
+}
+
+// idle samples the counters and reports whether they have not moved for
+// the whole timeout.
+func (w *idleWatcher) idle() bool {
+	now := w.now()
+	if t := w.traffic(); t != w.last {
+		w.last, w.lastActive = t, now
+		return false
+	}
+	return now.Sub(w.lastActive) >= w.timeout
+}
+
+func totalTraffic() int64 {
+	st := Stats()
+	return st.Up + st.Down
+}
+
+// startIdleWatch watches s with the configured idle timeout, if any and
+// s is not paused. Callers must hold lifecycleMu.
+func (s *session) startIdleWatch() {
+	if options.idleTimeout == 0 || s.device.rw.paused.Load() {
+		return
+	}
+	done := make(chan struct{})
+	s.idleDone = done
+	w := newIdleWatcher(options.idleTimeout, time.Now, totalTraffic)
+	go func() {
+		ticker := time.NewTicker(idleCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if w.idle() {
+					s.idleStop(done, w.timeout)
+					return
+				}
+			}
+		}
+	}()
+}
+
+// stopIdleWatch stops the watcher of s. Callers must hold lifecycleMu.
+func (s *session) stopIdleWatch() {
+	if s.idleDone != nil {
+		close(s.idleDone)
+		s.idleDone = nil
+	}
+}
+
+// idleStop stops s on behalf of the watcher that done belongs to.
+func (s *session) idleStop(done chan struct{}, timeout time.Duration) {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	if currentSession != s || s.idleDone != done {
+		// Stopped meanwhile, or the timeout was changed.
+		return
+	}
+	log.Infof("[MOBILE] no traffic for %v, stopping", timeout)
+	if err := stopLocked(0); err != nil {
+		log.Warnf("[MOBILE] %v", err)
+	}
+}
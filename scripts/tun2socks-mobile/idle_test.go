@@ -0,0 +1,46 @@
+package tun2socks
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestIdleWatcher(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	var traffic int64
+	w := newIdleWatcher(30*time.Second, clock.now, func() int64 { return traffic })
+
+	clock.advance(29 * time.Second)
+	if w.idle() {
+		t.Fatal("idle after 29s of a 30s timeout")
+	}
+
+	// A transfer moving bytes every few seconds keeps it awake.
+	for i := 0; i < 20; i++ {
+		clock.advance(5 * time.Second)
+		traffic += 100
+		if w.idle() {
+			t.Fatalf("idle during an active transfer (step %d)", i)
+		}
+	}
+
+	clock.advance(29 * time.Second)
+	if w.idle() {
+		t.Fatal("idle 29s after the last traffic")
+	}
+	clock.advance(time.Second)
+	if !w.idle() {
+		t.Fatal("not idle 30s after the last traffic")
+	}
+}
+
+func TestSetIdleTimeoutInvalid(t *testing.T) {
+	if err := SetIdleTimeout(-1); err == nil {
+		t.Error("SetIdleTimeout(-1) = nil, want error")
+	}
+}
@@ -0,0 +1,109 @@
+package tun2socks
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+type logFunc func(level, message string)
+
+func (f logFunc) OnLog(level, message string) { f(level, message) }
+
+// nopConnListener ignores every flow event.
+type nopConnListener struct{}
+
+func (nopConnListener) OnConnection(string, string, string)                     {}
+func (nopConnListener) OnConnectionClosed(string, string, string, int64, int64) {}
+
+func TestStartStopLeaksNoGoroutines(t *testing.T) {
+	defer Stop()
+	defer SetIdleTimeout(0)
+	defer SetAutoReconnect(false, 0)
+	defer SetLogCallback(nil)
+	defer SetConnectionListener(nil)
+	defer SetStateListener(nil)
+
+	// Idle watcher and auto-reconnect add per-session goroutines, and the
+	// callbacks make their forwarders busy.
+	if err := SetIdleTimeout(3600); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetAutoReconnect(true, 0); err != nil {
+		t.Fatal(err)
+	}
+	SetLogCallback(logFunc(func(string, string) {}))
+	SetConnectionListener(nopConnListener{})
+	SetStateListener(&stateRecorder{})
+
+	proxyUrl := "socks5://" + deadAddr(t)
+	app := [4]byte{10, 0, 0, 2}
+	remote := [4]byte{192, 0, 2, 1}
+	cycle := func(i int) {
+		if err := Start(testTunFd(t), proxyUrl, "silent"); err != nil {
+			t.Fatal(err)
+		}
+		failDials(reconnectFailures) /* starts the reconnect loop */
+		Stop()
+
+		// A session with open flows: a UDP one and a TCP one stuck
+		// dialing, both through a direct "proxy" to an address that
+		// never answers.
+		addr := freeUDPAddr(t)
+		if err := StartListener(addr, "direct://", "debug"); err != nil {
+			t.Fatal(err)
+		}
+		c, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		port := uint16(40000 + i)
+		c.Write(udpPacket(app, remote, port, 53, []byte("query")))
+		c.Write(tcpPacket(app, remote, port, 80, 1, 0, header.TCPFlagSyn))
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1500)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("no SYN-ACK: %v", err)
+		}
+		synAck := header.TCP(header.IPv4(buf[:n]).Payload())
+		c.Write(tcpPacket(app, remote, port, 80, 2, synAck.SequenceNumber()+1, header.TCPFlagAck))
+		for ConnectionCount().UDP == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		Stop()
+	}
+
+	// The first cycle starts the engine's lazily created goroutines, e.g.
+	// the UDP session reaper.
+	cycle(0)
+	base := settledGoroutines(-1)
+
+	for i := 1; i <= 100; i++ {
+		cycle(i)
+	}
+	if n := settledGoroutines(base); n > base+5 {
+		buf := make([]byte, 1<<20)
+		t.Errorf("%d goroutines after 100 Start/Stop cycles, want about %d\n%s",
+			n, base, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+// settledGoroutines waits up to 5 seconds for the goroutines of stopped
+// sessions to exit, i.e. for their count to drop to want, and returns it.
+func settledGoroutines(want int) int {
+	deadline := time.Now().Add(5 * time.Second)
+	n := runtime.NumGoroutine()
+	for time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		prev := n
+		if n = runtime.NumGoroutine(); n <= want || (want < 0 && n == prev) {
+			break
+		}
+	}
+	return n
+}
@@ -0,0 +1,93 @@
+package tun2socks
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// StartListener is like Start but runs the engine against a local UDP
+// listener instead of a TUN fd, for desktops, emulators and CI where no
+// VpnService is available. Each datagram sent to the listener is one raw
+// IPv4 or IPv6 packet, as read from a TUN; packets the engine sends back
+// go to the address the last datagram came from.
+//
+// listenAddr: "udp://127.0.0.1:5555", or just "127.0.0.1:5555"
+//
+// udp is the only device scheme: TCP has no packet boundaries. Only
+// loopback addresses are accepted, since whoever can send to the listener
+// can use the proxy. Everything else, including Stop and the state
+// listener, works as with Start.
+func StartListener(listenAddr string, proxyUrl, logLevel string) error {
+	dev, err := listenerDevice(listenAddr)
+	if err != nil {
+		return err
+	}
+	return start(&startParams{device: dev, proxyUrl: proxyUrl, logLevel: logLevel})
+}
+
+// listenerDevice validates a StartListener address and returns it as an
+// engine.Key device, "udp://host:port".
+func listenerDevice(s string) (string, error) {
+	if !strings.Contains(s, "://") {
+		s = "udp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen address: %w", err)
+	}
+	if u.Scheme != "udp" {
+		return "", fmt.Errorf("invalid listen address: unsupported scheme %q (supported: udp)", u.Scheme)
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen address: %w", err)
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return "", fmt.Errorf("invalid listen address: bad port %q", port)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf("invalid listen address: %q is not a loopback address", host)
+	}
+	return "udp://" + u.Host, nil
+}
+
+// openListenerDevice listens on the UDP address addr and wraps it in a
+// tunDevice.
+func openListenerDevice(addr string, mtu uint32, onFail func(error)) (*tunDevice, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return newTunDevice("udp", addr, &listenerFile{UDPConn: conn}, mtu, onFail)
+}
+
+// listenerFile is the packetFile of a UDP listener. It replies to the peer
+// that sent the last packet and drops replies until one has.
+type listenerFile struct {
+	*net.UDPConn
+	peer atomic.Pointer[net.UDPAddr]
+}
+
+func (f *listenerFile) Read(p []byte) (int, error) {
+	n, addr, err := f.ReadFromUDP(p)
+	if err == nil {
+		f.peer.Store(addr)
+	}
+	return n, err
+}
+
+func (f *listenerFile) Write(p []byte) (int, error) {
+	addr := f.peer.Load()
+	if addr == nil {
+		return len(p), nil
+	}
+	return f.WriteToUDP(p, addr)
+}
@@ -0,0 +1,137 @@
+package tun2socks
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+func TestListenerDevice(t *testing.T) {
+	tests := []struct {
+		addr, want, err string
+	}{
+		{"127.0.0.1:5555", "udp://127.0.0.1:5555", ""},
+		{"udp://[::1]:5555", "udp://[::1]:5555", ""},
+		{"udp://localhost:5555", "udp://localhost:5555", ""},
+		{"tcp://127.0.0.1:5555", "", "unsupported scheme"},
+		{"fd://3", "", "unsupported scheme"},
+		{"0.0.0.0:5555", "", "not a loopback address"},
+		{"127.0.0.1:0", "", "bad port"},
+		{"127.0.0.1", "", "invalid listen address"},
+	}
+	for _, tt := range tests {
+		got, err := listenerDevice(tt.addr)
+		if tt.err == "" {
+			if err != nil || got != tt.want {
+				t.Errorf("listenerDevice(%q) = %q, %v, want %q", tt.addr, got, err, tt.want)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("listenerDevice(%q) = %v, want error mentioning %q", tt.addr, err, tt.err)
+		}
+	}
+}
+
+// tcpPacket returns an IPv4 TCP segment from src to dst without payload.
+func tcpPacket(src, dst [4]byte, srcPort, dstPort uint16, seq, ack uint32, flags header.TCPFlags) []byte {
+	pkt := ipv4Packet(src, dst, header.TCPProtocolNumber, header.TCPMinimumSize)
+	ip := header.IPv4(pkt)
+	tcp := header.TCP(ip.Payload())
+	tcp.Encode(&header.TCPFields{
+		SrcPort:    srcPort,
+		DstPort:    dstPort,
+		SeqNum:     seq,
+		AckNum:     ack,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      flags,
+		WindowSize: 65535,
+	})
+	sum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), header.TCPMinimumSize)
+	tcp.SetChecksum(^tcp.CalculateChecksum(sum))
+	return pkt
+}
+
+// udpPacket returns an IPv4 UDP datagram from src to dst.
+func udpPacket(src, dst [4]byte, srcPort, dstPort uint16, payload []byte) []byte {
+	length := header.UDPMinimumSize + len(payload)
+	pkt := ipv4Packet(src, dst, header.UDPProtocolNumber, length)
+	ip := header.IPv4(pkt)
+	udp := header.UDP(ip.Payload())
+	udp.Encode(&header.UDPFields{SrcPort: srcPort, DstPort: dstPort, Length: uint16(length)})
+	copy(udp.Payload(), payload)
+	sum := header.PseudoHeaderChecksum(header.UDPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(length))
+	udp.SetChecksum(^udp.CalculateChecksum(checksum.Checksum(payload, sum)))
+	return pkt
+}
+
+// ipv4Packet returns an IPv4 packet with a payload of size bytes to fill.
+func ipv4Packet(src, dst [4]byte, proto tcpip.TransportProtocolNumber, size int) []byte {
+	pkt := make([]byte, header.IPv4MinimumSize+size)
+	ip := header.IPv4(pkt)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(pkt)),
+		TTL:         64,
+		Protocol:    uint8(proto),
+		SrcAddr:     tcpip.AddrFrom4(src),
+		DstAddr:     tcpip.AddrFrom4(dst),
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	return pkt
+}
+
+// freeUDPAddr returns a loopback UDP address nothing listens on.
+func freeUDPAddr(t *testing.T) string {
+	t.Helper()
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return c.LocalAddr().String()
+}
+
+func TestStartListener(t *testing.T) {
+	defer Stop()
+
+	addr := freeUDPAddr(t)
+	if err := StartListener(addr, "socks5://"+deadAddr(t), "silent"); err != nil {
+		t.Fatalf("StartListener = %v", err)
+	}
+	if !Running() {
+		t.Fatal("Running() = false after StartListener")
+	}
+
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write(tcpPacket([4]byte{10, 0, 0, 2}, [4]byte{192, 0, 2, 1}, 40000, 80, 1, 0, header.TCPFlagSyn)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The netstack answers the SYN before dialing the proxy.
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatalf("no reply from the listener: %v", err)
+	}
+	ip := header.IPv4(buf[:n])
+	if !ip.IsValid(n) || ip.TransportProtocol() != header.TCPProtocolNumber {
+		t.Fatalf("reply = %x, want an IPv4 TCP packet", buf[:n])
+	}
+	tcp := header.TCP(ip.Payload())
+	if tcp.Flags() != header.TCPFlagSyn|header.TCPFlagAck || tcp.DestinationPort() != 40000 {
+		t.Errorf("reply flags %v to port %d, want SYN|ACK to 40000", tcp.Flags(), tcp.DestinationPort())
+	}
+
+	Stop()
+	if err := StartListener(addr, "socks5://127.0.0.1:1080", "silent"); err != nil {
+		t.Errorf("StartListener after Stop = %v, want the address free again", err)
+	}
+}
@@ -0,0 +1,213 @@
+package tun2socks
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/xjasonlyu/tun2socks/v2/common/observable"
+	"github.com/xjasonlyu/tun2socks/v2/log"
+)
+
+const (
+	// logQueueSize bounds the batches waiting for the callback. When the
+	// callback falls behind, new lines are dropped rather than stalling the
+	// engine.
+	logQueueSize = 256
+
+	// defaultLogBufferLines is how many of the newest lines are kept.
+	defaultLogBufferLines = 200
+)
+
+// LogCallback receives engine log lines, e.g. to forward them to Logcat.
+type LogCallback interface {
+	OnLog(level string, message string)
+}
+
+type logCallbackHolder struct{ cb LogCallback }
+
+var (
+	// logMu guards logBuffer and logPending, and orders replayed lines
+	// before new ones.
+	logMu     sync.Mutex
+	logBuffer = newLogRing(defaultLogBufferLines)
+
+	// logPending is how many of the newest buffered lines were logged
+	// while no callback was set, and are replayed to the next one.
+	logPending int
+
+	logCallback atomic.Pointer[logCallbackHolder]
+	logQueue    = make(chan []*log.Event, logQueueSize)
+
+	// logVerbosity mirrors the engine log level; the engine publishes every
+	// event regardless of level, so lines above it are filtered here.
+	logVerbosity atomic.Uint32
+)
+
+func init() {
+	logVerbosity.Store(uint32(log.InfoLevel))
+	go deliverLogs()
+	go collectLogs(log.Subscribe())
+}
+
+// SetLogCallback forwards every engine log line to cb. It may be called
+// before or after Start; passing nil detaches the forwarder.
+//
+// Lines logged while no callback was set, from process start on, are
+// replayed to cb first from the log buffer (see SetLogBufferSize), so
+// startup errors are not lost. Delivery happens on a dedicated goroutine. If cb is
+// slow and the queue fills up, lines are dropped so packet processing is
+// never blocked.
+func SetLogCallback(cb LogCallback) {
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	if cb == nil {
+		logCallback.Store(nil)
+		return
+	}
+	logCallback.Store(&logCallbackHolder{cb: cb})
+	if lines := logBuffer.tail(logPending); len(lines) > 0 {
+		queueLogs(lines)
+	}
+	logPending = 0
+}
+
+// DrainLogs returns the buffered log lines, oldest first and one per line,
+// and empties the buffer. It is a pull-based alternative to SetLogCallback.
+// The buffer keeps the newest lines whether or not a callback is set, so
+// they are also at hand for Diagnostics; lines drained are not replayed to
+// a callback set later.
+func DrainLogs() string {
+	logMu.Lock()
+	lines := logBuffer.drain()
+	logPending = 0
+	logMu.Unlock()
+
+	var b strings.Builder
+	for _, e := range lines {
+		b.WriteString(formatLogLine(e))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// formatLogLine is the DrainLogs form of a line, without the newline.
+func formatLogLine(e *log.Event) string {
+	return fmt.Sprintf("%s [%s] %s", e.Time.Format("2006-01-02 15:04:05.000"), e.Level, e.Message)
+}
+
+// SetLogBufferSize sets how many of the newest lines are buffered; the
+// oldest are dropped beyond it. 0 disables buffering, and with it the
+// replay of early lines and the log tail of Diagnostics. The default is
+// 200.
+func SetLogBufferSize(lines int) error {
+	if lines < 0 {
+		return fmt.Errorf("invalid log buffer size: %d", lines)
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	logBuffer.resize(lines)
+	logPending = min(logPending, logBuffer.n)
+	return nil
+}
+
+// collectLogs buffers every line of sub and hands it to the callback, if
+// one is set.
+func collectLogs(sub observable.Subscription) {
+	for item := range sub {
+		e, ok := item.(*log.Event)
+		if !ok || uint32(e.Level) > logVerbosity.Load() {
+			continue
+		}
+		logMu.Lock()
+		logBuffer.push(e)
+		if logCallback.Load() != nil {
+			queueLogs([]*log.Event{e})
+		} else {
+			logPending = min(logPending+1, logBuffer.n)
+		}
+		logMu.Unlock()
+	}
+}
+
+func queueLogs(lines []*log.Event) {
+	select {
+	case logQueue <- lines:
+	default: /* callback is behind, drop */
+	}
+}
+
+func deliverLogs() {
+	for lines := range logQueue {
+		for _, e := range lines {
+			if h := logCallback.Load(); h != nil {
+				h.cb.OnLog(e.Level.String(), e.Message)
+			}
+		}
+	}
+}
+
+func setLogVerbosity(level string) {
+	if l, err := log.ParseLevel(level); err == nil {
+		logVerbosity.Store(uint32(l))
+	}
+}
+
+// logRing keeps the newest lines up to its size.
+type logRing struct {
+	lines []*log.Event
+	start int
+	n     int
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{lines: make([]*log.Event, size)}
+}
+
+func (r *logRing) push(e *log.Event) {
+	size := len(r.lines)
+	if size == 0 {
+		return
+	}
+	if r.n < size {
+		r.lines[(r.start+r.n)%size] = e
+		r.n++
+		return
+	}
+	r.lines[r.start] = e
+	r.start = (r.start + 1) % size
+}
+
+// drain returns the lines oldest first and empties r.
+func (r *logRing) drain() []*log.Event {
+	out := make([]*log.Event, r.n)
+	for i := range out {
+		out[i] = r.lines[(r.start+i)%len(r.lines)]
+	}
+	clear(r.lines)
+	r.start, r.n = 0, 0
+	return out
+}
+
+// tail returns up to the newest n lines, oldest first, leaving r as is.
+func (r *logRing) tail(n int) []*log.Event {
+	n = min(n, r.n)
+	out := make([]*log.Event, n)
+	for i := range out {
+		out[i] = r.lines[(r.start+r.n-n+i)%len(r.lines)]
+	}
+	return out
+}
+
+// resize changes the size of r, keeping the newest lines.
+func (r *logRing) resize(size int) {
+	lines := r.drain()
+	r.lines = make([]*log.Event, size)
+	for _, e := range lines[max(0, len(lines)-size):] {
+		r.push(e)
+	}
+}
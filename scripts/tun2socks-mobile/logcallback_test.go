@@ -0,0 +1,117 @@
+package tun2socks
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/log"
+)
+
+type logRecorder chan string
+
+// OnLog records the test's own lines, skipping any logged in the
+// background by earlier tests.
+func (r logRecorder) OnLog(level, message string) {
+	if strings.HasPrefix(message, "test:") {
+		r <- message
+	}
+}
+
+func TestLogRing(t *testing.T) {
+	r := newLogRing(3)
+	for i := 0; i < 5; i++ {
+		r.push(&log.Event{Message: fmt.Sprint(i)})
+	}
+	r.resize(2)
+	var got []string
+	for _, e := range r.drain() {
+		got = append(got, e.Message)
+	}
+	if want := []string{"3", "4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("drain() = %v, want %v", got, want)
+	}
+	if n := len(r.drain()); n != 0 {
+		t.Errorf("drain() after drain = %d lines, want 0", n)
+	}
+}
+
+// waitBuffered waits until the collector has buffered n lines.
+func waitBuffered(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		logMu.Lock()
+		got := logBuffer.n
+		logMu.Unlock()
+		if got >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d lines buffered, want %d", got, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLogBufferReplay(t *testing.T) {
+	setLogVerbosity("info")
+	DrainLogs()
+
+	log.Infof("test: early line")
+	waitBuffered(t, 1)
+	if got := DrainLogs(); !strings.Contains(got, "[info] test: early line") {
+		t.Errorf("DrainLogs() = %q, want the early line", got)
+	}
+
+	log.Infof("test: before callback 1")
+	log.Infof("test: before callback 2")
+	waitBuffered(t, 2)
+
+	rec := make(logRecorder, 8)
+	SetLogCallback(rec)
+	defer SetLogCallback(nil)
+	log.Infof("test: after callback")
+
+	for _, want := range []string{"test: before callback 1", "test: before callback 2", "test: after callback"} {
+		select {
+		case got := <-rec:
+			if got != want {
+				t.Errorf("OnLog(%q), want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("OnLog(%q) not called", want)
+		}
+	}
+	if got := DrainLogs(); !strings.Contains(got, "test: after callback") {
+		t.Errorf("DrainLogs() = %q with a callback set, want the line buffered too", got)
+	}
+
+	// Lines a callback already got are not replayed to the next one.
+	log.Infof("test: delivered")
+	if got := <-rec; got != "test: delivered" {
+		t.Errorf("OnLog(%q), want test: delivered", got)
+	}
+	SetLogCallback(nil)
+	log.Infof("test: while detached")
+	for deadline := time.Now().Add(time.Second); ; {
+		logMu.Lock()
+		pending := logPending
+		logMu.Unlock()
+		if pending > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	SetLogCallback(rec)
+	select {
+	case got := <-rec:
+		if got != "test: while detached" {
+			t.Errorf("OnLog(%q) replayed, want only test: while detached", got)
+		}
+	case <-time.After(time.Second):
+		t.Error("line logged while detached not replayed")
+	}
+}
@@ -0,0 +1,46 @@
+package tun2socks
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MetricsText returns the engine's counters in the Prometheus text
+// exposition format, for an app that serves them to a scraper. It works
+// with or without the REST API. The metric names are stable:
+//
+//	tun2socks_up                         1 while the engine is running, else 0
+//	tun2socks_upload_bytes_total         bytes sent through the proxy
+//	tun2socks_download_bytes_total       bytes received through the proxy
+//	tun2socks_tcp_flows                  TCP flows open now
+//	tun2socks_udp_flows                  UDP flows open now
+//	tun2socks_proxy_dial_failures_total  flows the proxy could not be dialed for
+//	tun2socks_reconnects_total           recoveries by auto-reconnect
+//
+// The counters are those of Stats and ConnectionCount, and restart from 0
+// on Start and ResetStats.
+func MetricsText() string {
+	m := collectMetrics()
+	up := 0
+	if m.running {
+		up = 1
+	}
+
+	var b strings.Builder
+	for _, metric := range []struct {
+		name, kind, help string
+		value            int64
+	}{
+		{"tun2socks_up", "gauge", "Whether the engine is running.", int64(up)},
+		{"tun2socks_upload_bytes_total", "counter", "Bytes sent through the proxy.", m.up},
+		{"tun2socks_download_bytes_total", "counter", "Bytes received through the proxy.", m.down},
+		{"tun2socks_tcp_flows", "gauge", "TCP flows currently open.", int64(m.tcpFlows)},
+		{"tun2socks_udp_flows", "gauge", "UDP flows currently open.", int64(m.udpFlows)},
+		{"tun2socks_proxy_dial_failures_total", "counter", "Flows the upstream proxy could not be dialed for.", m.dialFailures},
+		{"tun2socks_reconnects_total", "counter", "Recoveries by auto-reconnect.", m.reconnects},
+	} {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %d\n",
+			metric.name, metric.help, metric.name, metric.kind, metric.name, metric.value)
+	}
+	return b.String()
+}
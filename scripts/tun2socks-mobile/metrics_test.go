@@ -0,0 +1,38 @@
+package tun2socks
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetricsText(t *testing.T) {
+	defer Stop()
+
+	if got := MetricsText(); !strings.Contains(got, "\ntun2socks_up 0\n") {
+		t.Errorf("MetricsText() = %q when not running, want tun2socks_up 0", got)
+	}
+	if err := Start(testTunFd(t), "socks5://"+deadAddr(t), "silent"); err != nil {
+		t.Fatal(err)
+	}
+	failDials(2)
+
+	got := MetricsText()
+	for _, want := range []string{
+		"# TYPE tun2socks_up gauge\ntun2socks_up 1\n",
+		"# TYPE tun2socks_upload_bytes_total counter\ntun2socks_upload_bytes_total 0\n",
+		"\ntun2socks_download_bytes_total 0\n",
+		"\ntun2socks_tcp_flows 0\n",
+		"\ntun2socks_udp_flows 0\n",
+		"# TYPE tun2socks_proxy_dial_failures_total counter\ntun2socks_proxy_dial_failures_total 2\n",
+		"\ntun2socks_reconnects_total 0\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("MetricsText() = %q, want it to contain %q", got, want)
+		}
+	}
+
+	ResetStats()
+	if got := MetricsText(); !strings.Contains(got, "\ntun2socks_proxy_dial_failures_total 0\n") {
+		t.Errorf("MetricsText() = %q after ResetStats, want no dial failures", got)
+	}
+}
@@ -0,0 +1,336 @@
+package tun2socks
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// testTunFd returns a datagram socket standing in for a TUN fd. The engine
+// closes it on Stop; the peer end is closed when the test ends.
+func testTunFd(t *testing.T) int {
+	t.Helper()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.Close(fds[1]) })
+	return fds[0]
+}
+
+func TestConcurrentStart(t *testing.T) {
+	defer Stop()
+
+	fd := testTunFd(t)
+
+	const n = 8
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, n)
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- Start(fd, "socks5://127.0.0.1:1080", "silent")
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	var ok int
+	for err := range errs {
+		switch err {
+		case nil:
+			ok++
+		case errAlreadyRunning:
+		default:
+			t.Errorf("Start = %v, want nil or %v", err, errAlreadyRunning)
+		}
+	}
+	if ok != 1 {
+		t.Errorf("%d concurrent Start calls succeeded, want 1", ok)
+	}
+	if !Running() {
+		t.Error("Running() = false after Start")
+	}
+
+	Stop()
+	if Running() {
+		t.Error("Running() = true after Stop")
+	}
+}
+
+type stateRecorder struct {
+	mu     sync.Mutex
+	states []string
+}
+
+func (r *stateRecorder) OnStateChanged(state string) {
+	r.mu.Lock()
+	r.states = append(r.states, state)
+	r.mu.Unlock()
+}
+
+func (r *stateRecorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.states...)
+}
+
+func TestTunFdGoneStops(t *testing.T) {
+	defer Stop()
+
+	// Closing the write end makes every read of the "TUN" fail, as a
+	// revoked VPN does.
+	var p [2]int
+	if err := unix.Pipe(p[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &stateRecorder{}
+	SetStateListener(rec)
+	defer SetStateListener(nil)
+
+	if err := Start(p[0], "socks5://127.0.0.1:1080", "silent"); err != nil {
+		t.Fatalf("Start = %v", err)
+	}
+	unix.Close(p[1])
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		states := rec.get()
+		if n := len(states); n > 0 && states[n-1] == StateStopped {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("states = %v, want the engine to stop on its own", states)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if Running() {
+		t.Error("Running() = true after the TUN fd failed")
+	}
+	want := []string{StateStarting, StateConnected, StateError, StateStopping, StateStopped}
+	if got := rec.get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("states = %v, want %v", got, want)
+	}
+
+	if msg := LastError(); !strings.Contains(msg, "tun device failed") {
+		t.Errorf("LastError() = %q, want the device failure", msg)
+	}
+
+	// The wrapper must be able to start again afterwards.
+	if err := Start(testTunFd(t), "socks5://127.0.0.1:1080", "silent"); err != nil {
+		t.Errorf("Start after fd failure = %v", err)
+	}
+	if msg := LastError(); msg != "" {
+		t.Errorf("LastError() = %q after a successful Start, want empty", msg)
+	}
+}
+
+func TestStopTwice(t *testing.T) {
+	rec := &stateRecorder{}
+	SetStateListener(rec)
+	defer SetStateListener(nil)
+
+	countStopped := func() int {
+		n := 0
+		for _, s := range rec.get() {
+			if s == StateStopped {
+				n++
+			}
+		}
+		return n
+	}
+
+	if err := Start(testTunFd(t), "socks5://127.0.0.1:1080", "silent"); err != nil {
+		t.Fatal(err)
+	}
+	Stop()
+	Stop()
+	if n := countStopped(); n != 1 {
+		t.Errorf("Stop twice in a row: %d stops, want 1", n)
+	}
+
+	if err := Start(testTunFd(t), "socks5://127.0.0.1:1080", "silent"); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Stop()
+		}()
+	}
+	wg.Wait()
+	if n := countStopped(); n != 2 {
+		t.Errorf("concurrent Stop: %d stops in total, want 2", n)
+	}
+	if Running() {
+		t.Error("Running() = true after Stop")
+	}
+}
+
+// TestStartAfterFailedStart guards against a failed start leaving the
+// engine wedged, as recovering from the engine's own Start used to: it
+// returned with its lock held, so the next Start or Stop hung.
+func TestStartAfterFailedStart(t *testing.T) {
+	defer SetOutboundInterface("")
+
+	// An interface that went away after SetOutboundInterface makes the
+	// session fail to open.
+	lifecycleMu.Lock()
+	options.outboundIf = "kotkit-missing0"
+	lifecycleMu.Unlock()
+	if err := Start(testTunFd(t), "socks5://127.0.0.1:1080", "silent"); err == nil {
+		t.Fatal("Start with a missing outbound interface = nil error")
+	}
+	if Running() {
+		t.Fatal("Running() = true after a failed Start")
+	}
+	SetOutboundInterface("")
+
+	done := make(chan error, 1)
+	go func() {
+		err := Start(testTunFd(t), "socks5://127.0.0.1:1080", "silent")
+		Stop()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Start after a failed Start = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start and Stop after a failed Start hung")
+	}
+}
+
+func TestStartAndWait(t *testing.T) {
+	defer Stop()
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[1])
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		// Any datagram counts as a packet; the netstack drops this one.
+		unix.Write(fds[1], make([]byte, 20))
+	}()
+	if err := StartAndWait(fds[0], "socks5://127.0.0.1:1080", "silent", 2000); err != nil {
+		t.Fatalf("StartAndWait = %v", err)
+	}
+	Stop()
+
+	// Nothing is written to this one.
+	if err := StartAndWait(testTunFd(t), "socks5://127.0.0.1:1080", "silent", 100); err == nil {
+		t.Error("StartAndWait = nil without any packet, want timeout error")
+	}
+}
+
+// connectTargets serves as an HTTP proxy that answers every CONNECT and
+// reports its target.
+func connectTargets(t *testing.T) (addr string, targets <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ch := make(chan string, 8)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				req, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil {
+					return
+				}
+				ch <- req.Host
+				c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			}()
+		}
+	}()
+	return ln.Addr().String(), ch
+}
+
+func TestRestart(t *testing.T) {
+	defer Stop()
+
+	if err := Restart("socks5://127.0.0.1:1080"); err == nil {
+		t.Error("Restart = nil error when not running")
+	}
+
+	rec := &stateRecorder{}
+	SetStateListener(rec)
+	defer SetStateListener(nil)
+
+	first, firstTargets := connectTargets(t)
+	second, secondTargets := connectTargets(t)
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[1])
+	if err := Start(fds[0], "http://"+first, "silent"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Restart("http://" + second); err != nil {
+		t.Fatalf("Restart = %v", err)
+	}
+	if err := Restart("bogus://x"); err == nil {
+		t.Error("Restart(bogus) = nil error")
+	}
+	if c := CurrentConfig(); !strings.Contains(c, second) {
+		t.Errorf("CurrentConfig() = %s, want the new proxy", c)
+	}
+
+	// A new TCP flow from the app goes to the new proxy.
+	app, remote := [4]byte{10, 0, 0, 2}, [4]byte{192, 0, 2, 1}
+	unix.Write(fds[1], tcpPacket(app, remote, 40000, 443, 1, 0, header.TCPFlagSyn))
+	unix.SetsockoptTimeval(fds[1], unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 5})
+	buf := make([]byte, 1500)
+	n, err := unix.Read(fds[1], buf)
+	if err != nil {
+		t.Fatalf("no SYN-ACK: %v", err)
+	}
+	synAck := header.TCP(header.IPv4(buf[:n]).Payload())
+	unix.Write(fds[1], tcpPacket(app, remote, 40000, 443, 2, synAck.SequenceNumber()+1, header.TCPFlagAck))
+	select {
+	case got := <-secondTargets:
+		if got != "192.0.2.1:443" {
+			t.Errorf("CONNECT %s, want 192.0.2.1:443", got)
+		}
+	case got := <-firstTargets:
+		t.Errorf("CONNECT %s reached the old proxy", got)
+	case <-time.After(5 * time.Second):
+		t.Error("no CONNECT reached the new proxy")
+	}
+
+	if !Running() {
+		t.Error("Running() = false after Restart")
+	}
+	Stop()
+	want := []string{StateStarting, StateConnected, StateStopping, StateStopped}
+	if got := rec.get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("states = %v, want %v", got, want)
+	}
+}
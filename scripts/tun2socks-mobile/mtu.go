@@ -0,0 +1,106 @@
+package tun2socks
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/xjasonlyu/tun2socks/v2/log"
+)
+
+// Bounds for StartAutoMTU: the IPv6 minimum and the Ethernet default.
+const (
+	minAutoMTU = 1280
+	maxAutoMTU = 1500
+)
+
+// mtuProbeTimeout bounds resolving the proxy host for the MTU probe.
+const mtuProbeTimeout = 2 * time.Second
+
+// StartAutoMTU is like Start but picks the MTU from the path MTU towards
+// the proxy host, clamped to 1280..1500. This avoids black-holed packets on
+// tunneled carrier links whose MTU is below 1500.
+//
+// The estimate comes from the kernel: the MTU of the route to the proxy,
+// lowered by any path MTU it has already learned from ICMP. No probe
+// packets are sent. If it cannot be determined, e.g. for a direct:// proxy,
+// 1500 is used and a warning is logged. The caller must give the same MTU
+// to VpnService.Builder.setMtu(); use PathMTU first in that case.
+func StartAutoMTU(tunFd int, proxyUrl, logLevel string) error {
+	mtu, err := PathMTU(proxyUrl)
+	if err != nil {
+		return err
+	}
+	return StartWithMTU(tunFd, proxyUrl, logLevel, mtu)
+}
+
+// PathMTU returns the MTU StartAutoMTU would use for proxyUrl.
+func PathMTU(proxyUrl string) (int, error) {
+	if err := validateProxy(proxyUrl); err != nil {
+		return 0, err
+	}
+	p, _ := parseProxy(proxyUrl)
+
+	mtu, err := probePathMTU(p.Addr())
+	if err != nil {
+		log.Warnf("[MOBILE] path mtu to %s: %v, using %d", p.Addr(), err, maxAutoMTU)
+		return maxAutoMTU, nil
+	}
+	return min(max(mtu, minAutoMTU), maxAutoMTU), nil
+}
+
+// probePathMTU reads the kernel's path MTU to the host of addr from a
+// connected UDP socket with the DF bit set.
+func probePathMTU(addr string) (int, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return 0, fmt.Errorf("no host to probe: %w", err)
+	}
+	d := net.Dialer{
+		Timeout: mtuProbeTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			if err := controlSocket(network, address, c); err != nil {
+				return err
+			}
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				if network == "udp6" {
+					serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO)
+				} else {
+					serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	c, err := d.Dial("udp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	raw, err := c.(*net.UDPConn).SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	v6 := c.RemoteAddr().(*net.UDPAddr).IP.To4() == nil
+	var (
+		mtu  int
+		serr error
+	)
+	if err := raw.Control(func(fd uintptr) {
+		if v6 {
+			mtu, serr = unix.GetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU)
+		} else {
+			mtu, serr = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU)
+		}
+	}); err != nil {
+		return 0, err
+	}
+	return mtu, serr
+}
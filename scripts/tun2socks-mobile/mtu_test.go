@@ -0,0 +1,24 @@
+package tun2socks
+
+import "testing"
+
+func TestPathMTU(t *testing.T) {
+	tests := []struct {
+		url  string
+		want int
+	}{
+		// Loopback has a 64KiB MTU, clamped to the maximum.
+		{"socks5://127.0.0.1:1080", maxAutoMTU},
+		// Nothing to probe: falls back to the default.
+		{"direct://", maxAutoMTU},
+	}
+	for _, tt := range tests {
+		mtu, err := PathMTU(tt.url)
+		if err != nil || mtu != tt.want {
+			t.Errorf("PathMTU(%q) = %d, %v, want %d", tt.url, mtu, err, tt.want)
+		}
+	}
+	if _, err := PathMTU("ftp://127.0.0.1:21"); err == nil {
+		t.Error("PathMTU(ftp) = nil error")
+	}
+}
@@ -0,0 +1,255 @@
+package tun2socks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/docker/go-units"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	"github.com/xjasonlyu/tun2socks/v2/core"
+	"github.com/xjasonlyu/tun2socks/v2/core/option"
+	"github.com/xjasonlyu/tun2socks/v2/dialer"
+	"github.com/xjasonlyu/tun2socks/v2/engine"
+	"github.com/xjasonlyu/tun2socks/v2/engine/mirror"
+	"github.com/xjasonlyu/tun2socks/v2/log"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+	"github.com/xjasonlyu/tun2socks/v2/restapi"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/statistic"
+)
+
+// session is one running engine. It follows engine.Start step by step for
+// an engine.Key, but builds the netstack around a tunDevice, since the
+// engine opens its device internally with no way to observe it.
+type session struct {
+	key      *engine.Key
+	device   *tunDevice
+	stack    *stack.Stack
+	upstream proxy.Proxy
+
+	// dispatcher is the one set by setUpstream; proxyUrls is the StartMulti
+	// list, if any.
+	dispatcher *dispatcher
+	proxyUrls  []string
+
+	// idleDone stops the idle watcher and reconnectDone the reconnect
+	// loop, both guarded by lifecycleMu.
+	idleDone      chan struct{}
+	reconnectDone chan struct{}
+
+	// ctx ends when the session is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+var (
+	// currentSession is the running session, guarded by lifecycleMu.
+	currentSession *session
+
+	// activeStack is read by the REST API stats handler.
+	activeStack atomic.Pointer[stack.Stack]
+
+	// restAPIServing records the REST API addresses already served; the
+	// engine gives no way to stop a server once started.
+	restAPIServing = map[string]bool{}
+)
+
+// openSession brings up the engine for key, dialing through upstream rather
+// than key.Proxy so it can be a proxyPool. onFail is called once if the
+// TUN device fails while the session is running. Callers must hold
+// lifecycleMu.
+func openSession(key *engine.Key, upstream proxy.Proxy, onFail func(*session, error)) (s *session, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("engine start: %v", r)
+		}
+	}()
+
+	if err := applyGeneral(key); err != nil {
+		return nil, err
+	}
+	opts, err := stackOptions(key)
+	if err != nil {
+		return nil, err
+	}
+	s = &session{key: key}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	if s.device, err = openDevice(key.Device, uint32(key.MTU), func(err error) { onFail(s, err) }); err != nil {
+		s.cancel()
+		return nil, err
+	}
+	s.setUpstream(upstream)
+
+	if err := s.createStack(opts); err != nil {
+		s.cancel()
+		activeDispatcher.CompareAndSwap(s.dispatcher, nil)
+		s.device.Close()
+		return nil, err
+	}
+
+	if err := startRestAPI(key.RestAPI); err != nil {
+		log.Warnf("[RESTAPI] %v", err)
+	}
+
+	log.Infof(
+		"[STACK] %s://%s <-> %s://%s",
+		s.device.Type(), s.device.Name(),
+		upstream.Proto(), upstream.Addr(),
+	)
+	return s, nil
+}
+
+func (s *session) createStack(opts []option.Option) error {
+	ep := &stackEndpoint{tunDevice: s.device, handler: &mirror.Tunnel{}}
+	st, err := core.CreateStack(&core.Config{
+		LinkEndpoint:     ep,
+		TransportHandler: ep.handler,
+		Options:          append(opts, ep.withStack()),
+	})
+	if err != nil {
+		return err
+	}
+	s.stack = st
+	activeStack.Store(st)
+	return nil
+}
+
+// rebuildStack replaces the netstack and its link endpoint with ones made
+// for s.key, keeping the TUN fd open. Connections through the old stack
+// are reset. On error the session has no stack left and must be stopped.
+// Callers must hold lifecycleMu.
+func (s *session) rebuildStack() error {
+	opts, err := stackOptions(s.key)
+	if err != nil {
+		return err
+	}
+	if err := s.device.detach(); err != nil {
+		return fmt.Errorf("detach tun device: %w", err)
+	}
+	s.stack.Close()
+	s.stack.Wait()
+	activeStack.CompareAndSwap(s.stack, nil)
+	closeFlows()
+
+	if err := s.device.reattach(uint32(s.key.MTU)); err != nil {
+		return err
+	}
+	return s.createStack(opts)
+}
+
+// close tears the session down, closing the TUN fd. It cancels the dials
+// in flight and closes every flow, so no goroutine of the session outlives
+// it by more than the time to notice.
+func (s *session) close() error {
+	s.cancel()
+	activeDispatcher.CompareAndSwap(s.dispatcher, nil)
+	err := s.device.Close()
+	s.stack.Close()
+	s.stack.Wait()
+	activeStack.CompareAndSwap(s.stack, nil)
+	closeFlows()
+	return err
+}
+
+// closeFlows closes the proxy side of every flow the engine tracks, so
+// their relays end now rather than after the UDP timeout or the TCP
+// half-close timeout. Only one session runs at a time, so they all belong
+// to it.
+func closeFlows() {
+	for _, c := range statistic.DefaultManager.Snapshot().Connections {
+		c.Close()
+	}
+}
+
+// applyGeneral applies the process-wide engine settings of key. Settings
+// left empty are reset, so nothing leaks over from a previous session.
+func applyGeneral(key *engine.Key) error {
+	level, err := log.ParseLevel(key.LogLevel)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(level)
+
+	var (
+		name  string
+		index int
+	)
+	if key.Interface != "" {
+		iface, err := net.InterfaceByName(key.Interface)
+		if err != nil {
+			return fmt.Errorf("invalid outbound interface %q: %w", key.Interface, err)
+		}
+		name, index = iface.Name, iface.Index
+		log.Infof("[DIALER] bind to interface: %s", key.Interface)
+	}
+	dialer.DefaultInterfaceName.Store(name)
+	dialer.DefaultInterfaceIndex.Store(int32(index))
+	dialer.DefaultRoutingMark.Store(int32(key.Mark))
+
+	if key.UDPTimeout > 0 {
+		setEngineUDPTimeout(key.UDPTimeout)
+	}
+	return nil
+}
+
+func stackOptions(key *engine.Key) ([]option.Option, error) {
+	var opts []option.Option
+	if key.TCPModerateReceiveBuffer {
+		opts = append(opts, option.WithTCPModerateReceiveBuffer(true))
+	}
+	if key.TCPSendBufferSize != "" {
+		size, err := units.RAMInBytes(key.TCPSendBufferSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tcp send buffer size: %w", err)
+		}
+		opts = append(opts, option.WithTCPSendBufferSize(int(size)))
+	}
+	if key.TCPReceiveBufferSize != "" {
+		size, err := units.RAMInBytes(key.TCPReceiveBufferSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tcp receive buffer size: %w", err)
+		}
+		opts = append(opts, option.WithTCPReceiveBufferSize(int(size)))
+	}
+	return opts, nil
+}
+
+// startRestAPI serves the engine REST API on addr unless it already is.
+func startRestAPI(addr string) error {
+	if addr == "" || restAPIServing[addr] {
+		return nil
+	}
+	addr = restAPIURL(addr)
+	u, err := url.Parse(addr)
+	if err != nil {
+		return err
+	}
+
+	restapi.SetStatsFunc(func() tcpip.Stats {
+		if s := activeStack.Load(); s != nil {
+			return s.Stats()
+		}
+		return tcpip.Stats{}
+	})
+	go func() {
+		if err := restapi.Start(u.Host, u.User.String()); err != nil {
+			log.Warnf("[RESTAPI] failed to start: %v", err)
+		}
+	}()
+	restAPIServing[addr] = true
+	log.Infof("[RESTAPI] serve at: %s", u)
+	return nil
+}
+
+// restAPIURL adds the http:// scheme the REST API address may omit.
+func restAPIURL(addr string) string {
+	if addr != "" && !strings.Contains(addr, "://") {
+		return "http://" + addr
+	}
+	return addr
+}
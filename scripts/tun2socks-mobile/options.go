@@ -0,0 +1,320 @@
+package tun2socks
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/tunnel"
+)
+
+// defaultUDPTimeout mirrors the engine's built-in UDP session timeout.
+const defaultUDPTimeout = 60 * time.Second
+
+// TCP buffer size bounds of the engine's netstack; a default outside them
+// makes stack creation fail.
+const (
+	minTCPBufferSize = 4 << 10
+	maxTCPBufferSize = 4 << 20
+)
+
+// options holds the settings configured through the Set* functions. They
+// are guarded by lifecycleMu and take effect on the next Start unless
+// documented otherwise.
+var options struct {
+	udpTimeout  time.Duration
+	bypassCIDRs []*net.IPNet
+	udpDisabled bool
+	probeAddr   string
+	dialTimeout time.Duration
+	dnsIP       net.IP
+	dnsPort     uint16
+
+	tcpSendBufferSize    int
+	tcpReceiveBufferSize int
+
+	tunName    string
+	tunAddrs   []net.IP
+	outboundIf string
+
+	idleTimeout time.Duration
+	domainRules []domainRule
+
+	autoReconnect bool
+	maxBackoff    time.Duration
+
+	blockCIDRs []*net.IPNet
+	allowCIDRs []*net.IPNet
+
+	fakeIPNet *net.IPNet
+}
+
+// SetUDPTimeout sets how long an idle UDP session is kept before it is
+// torn down, in seconds. 0 restores the engine default of 60 seconds.
+//
+// It takes effect at the next Start: a running engine keeps its timeout
+// until it is stopped and started again.
+func SetUDPTimeout(seconds int) error {
+	if seconds < 0 {
+		return fmt.Errorf("invalid udp timeout: %d", seconds)
+	}
+
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	options.udpTimeout = time.Duration(seconds) * time.Second
+	return nil
+}
+
+// udpTimeout returns the configured UDP timeout with the default applied.
+func udpTimeout() time.Duration {
+	if options.udpTimeout == 0 {
+		return defaultUDPTimeout
+	}
+	return options.udpTimeout
+}
+
+// engineUDPTimeout is the value last given to tunnel.SetUDPTimeout. The
+// engine reads it unsynchronized from every UDP relay, so it is only set
+// while starting, before the new session relays anything, and only when
+// it changes. Guarded by lifecycleMu.
+var engineUDPTimeout = defaultUDPTimeout
+
+func setEngineUDPTimeout(d time.Duration) {
+	if d != engineUDPTimeout {
+		engineUDPTimeout = d
+		tunnel.SetUDPTimeout(d)
+	}
+}
+
+// SetUDPEnabled controls whether UDP flows are sent through the proxy. Use
+// false for proxies that only support TCP CONNECT and mishandle UDP
+// ASSOCIATE; UDP packets are then dropped instead of proxied, so nothing
+// leaks outside the tunnel. Enabled by default; set before Start.
+//
+// With UDP disabled, plain DNS (UDP port 53) stops working too: the system
+// must be configured to resolve over TCP (DNS-over-TCP, or DoT/DoH).
+func SetUDPEnabled(enabled bool) {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	options.udpDisabled = !enabled
+}
+
+// SetDialTimeout sets how long a new flow may take to connect through the
+// proxy, in milliseconds. It covers both dialing the proxy and its
+// handshake, e.g. waiting for the HTTP CONNECT response or the SOCKS5 UDP
+// ASSOCIATE reply, which the engine does not bound by itself. The default
+// is 5000; set before Start.
+func SetDialTimeout(milliseconds int) error {
+	if milliseconds <= 0 {
+		return fmt.Errorf("invalid dial timeout: %d", milliseconds)
+	}
+
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	options.dialTimeout = time.Duration(milliseconds) * time.Millisecond
+	return nil
+}
+
+// SetDNS redirects all DNS traffic (UDP and TCP port 53, whatever server
+// the app asked for) to the resolver at address, e.g. "1.1.1.1:53", through
+// the proxy. This keeps plain DNS from leaking outside the tunnel. An empty
+// string turns the redirect off; set before Start.
+//
+// DNS-over-HTTPS and DNS-over-TLS (port 443/853) look like ordinary
+// encrypted traffic and are not redirected: apps or an Android "Private
+// DNS" setting using them keep talking to their own resolver, still via the
+// proxy.
+func SetDNS(address string) error {
+	var (
+		ip   net.IP
+		port uint16
+	)
+	if address != "" {
+		var err error
+		if ip, port, err = splitIPPort(address); err != nil {
+			return err
+		}
+	}
+
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	options.dnsIP, options.dnsPort = ip, port
+	return nil
+}
+
+// SetTCPBufferSize sets the default TCP send and receive buffer sizes of
+// the engine's netstack, in bytes, e.g. 4<<20 for 4 MiB. 0 keeps the engine
+// default of 1 MiB. Values must be between 4 KiB and 4 MiB, the most the
+// netstack accepts; set before Start.
+//
+// Larger buffers raise throughput on high-latency links but are allocated
+// per connection, so on low-end devices with many open flows they cost
+// noticeable memory.
+func SetTCPBufferSize(sendBytes, recvBytes int) error {
+	for _, size := range []int{sendBytes, recvBytes} {
+		if size != 0 && (size < minTCPBufferSize || size > maxTCPBufferSize) {
+			return fmt.Errorf("invalid tcp buffer size %d: must be between %d and %d",
+				size, minTCPBufferSize, maxTCPBufferSize)
+		}
+	}
+
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	options.tcpSendBufferSize = sendBytes
+	options.tcpReceiveBufferSize = recvBytes
+	return nil
+}
+
+// SetTunInterface describes the TUN device set up with VpnService.Builder:
+// its interface name (e.g. "tun0") and the IPv4/IPv6 addresses given to
+// addAddress(), with or without a prefix length. Either address may be
+// empty. Set before Start.
+//
+// The name labels the engine's log lines. Flows addressed to the TUN's own
+// addresses are refused instead of being sent to the proxy, which could
+// never reach them.
+func SetTunInterface(name, ipv4, ipv6 string) error {
+	var addrs []net.IP
+	for _, a := range []struct {
+		addr, family string
+		v4           bool
+	}{{ipv4, "IPv4", true}, {ipv6, "IPv6", false}} {
+		if a.addr == "" {
+			continue
+		}
+		ip := net.ParseIP(a.addr)
+		if ip == nil {
+			var err error
+			if ip, _, err = net.ParseCIDR(a.addr); err != nil {
+				return fmt.Errorf("invalid tun address: %q", a.addr)
+			}
+		}
+		if (ip.To4() != nil) != a.v4 {
+			return fmt.Errorf("invalid tun address: %q is not %s", a.addr, a.family)
+		}
+		addrs = append(addrs, ip)
+	}
+
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	options.tunName, options.tunAddrs = name, addrs
+	return nil
+}
+
+// SetOutboundInterface binds the engine's sockets to the proxy (and direct
+// flows) to the named network interface, e.g. "wlan0" or "rmnet_data0",
+// for devices with several uplinks where the default route is the wrong
+// one. This is engine.Key.Interface; it must never be the TUN interface.
+// An empty name restores normal routing; set before Start.
+func SetOutboundInterface(name string) error {
+	if name != "" {
+		if _, err := net.InterfaceByName(name); err != nil {
+			return fmt.Errorf("invalid outbound interface %q: %w", name, err)
+		}
+	}
+
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	options.outboundIf = name
+	return nil
+}
+
+// SetBypassCIDRs sets the destinations that are dialed directly instead of
+// through the proxy, e.g. the proxy server itself or a captive-portal check
+// host. cidrs is a comma-separated list such as "10.0.0.0/8, 2001:db8::/32";
+// an empty string clears the list.
+//
+// It must be called before Start to take effect. On error the previous
+// list is kept and the error names every entry that failed to parse.
+func SetBypassCIDRs(cidrs string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	options.bypassCIDRs = nets
+	return nil
+}
+
+// SetBlockCIDRs blocks every connection to the given destinations, whatever
+// the proxy, e.g. for parental controls. cidrs is a comma-separated list as
+// for SetBypassCIDRs; an empty string clears it. It applies immediately to
+// new connections.
+//
+// A blocked TCP connection is refused with a reset before the netstack
+// accepts it, so the app gets "connection refused"; UDP packets to a
+// blocked destination are dropped. On error the previous list is kept.
+func SetBlockCIDRs(cidrs string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	options.blockCIDRs = nets
+	refreshDispatcher()
+	return nil
+}
+
+// SetAllowOnlyCIDRs blocks every connection except those to the given
+// destinations. When both lists are set, the allow list acts as a
+// whitelist and the block list still applies within it. An empty string
+// clears it; otherwise it behaves like SetBlockCIDRs.
+func SetAllowOnlyCIDRs(cidrs string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	options.allowCIDRs = nets
+	refreshDispatcher()
+	return nil
+}
+
+// refreshDispatcher makes the running engine pick up changed options for
+// new flows. Callers must hold lifecycleMu.
+func refreshDispatcher() {
+	if s := currentSession; s != nil {
+		s.setUpstream(s.upstream)
+	}
+}
+
+// parseCIDRs parses a comma-separated list of CIDR blocks.
+func parseCIDRs(cidrs string) ([]*net.IPNet, error) {
+	var (
+		nets []*net.IPNet
+		bad  []string
+	)
+	for _, s := range strings.Split(cidrs, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			bad = append(bad, s)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	if len(bad) > 0 {
+		return nil, fmt.Errorf("invalid CIDRs: %s", strings.Join(bad, ", "))
+	}
+	return nets, nil
+}
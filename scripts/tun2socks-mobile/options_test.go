@@ -0,0 +1,88 @@
+package tun2socks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSetTCPBufferSize(t *testing.T) {
+	defer SetTCPBufferSize(0, 0)
+
+	if err := SetTCPBufferSize(256<<10, 4<<20); err != nil {
+		t.Fatal(err)
+	}
+	key := newKey(&startParams{tunFd: 3, proxyUrl: "socks5://1.2.3.4:1080", logLevel: "info", mtu: defaultMTU})
+	if key.TCPSendBufferSize != "262144" || key.TCPReceiveBufferSize != "4194304" {
+		t.Errorf("key buffer sizes = %q/%q, want 262144/4194304",
+			key.TCPSendBufferSize, key.TCPReceiveBufferSize)
+	}
+
+	if err := SetTCPBufferSize(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	key = newKey(&startParams{tunFd: 3, proxyUrl: "socks5://1.2.3.4:1080", logLevel: "info", mtu: defaultMTU})
+	if key.TCPSendBufferSize != "" || key.TCPReceiveBufferSize != "" {
+		t.Errorf("key buffer sizes = %q/%q, want engine defaults",
+			key.TCPSendBufferSize, key.TCPReceiveBufferSize)
+	}
+}
+
+func TestSetTCPBufferSizeInvalid(t *testing.T) {
+	for _, sizes := range [][2]int{{1024, 0}, {0, 16 << 20}, {-1, 64 << 10}} {
+		if err := SetTCPBufferSize(sizes[0], sizes[1]); err == nil {
+			t.Errorf("SetTCPBufferSize(%d, %d) = nil, want error", sizes[0], sizes[1])
+		}
+	}
+}
+
+func TestSetTunInterface(t *testing.T) {
+	defer SetTunInterface("", "", "")
+
+	if err := SetTunInterface("tun0", "10.0.0.2/32", "fd00::2"); err != nil {
+		t.Fatal(err)
+	}
+	d := newDispatcher(nil)
+	if len(d.local) != 2 || !d.local[0].Equal(net.ParseIP("10.0.0.2")) || !d.local[1].Equal(net.ParseIP("fd00::2")) {
+		t.Errorf("dispatcher local addresses = %v", d.local)
+	}
+
+	for _, addrs := range [][2]string{{"fd00::2", ""}, {"", "10.0.0.2"}, {"10.0.0.256", ""}} {
+		if err := SetTunInterface("tun0", addrs[0], addrs[1]); err == nil {
+			t.Errorf("SetTunInterface(%q, %q) = nil, want error", addrs[0], addrs[1])
+		}
+	}
+}
+
+func TestSetUDPTimeoutAppliesAtStart(t *testing.T) {
+	defer Stop()
+	defer SetUDPTimeout(0)
+
+	if err := SetUDPTimeout(-1); err == nil {
+		t.Error("SetUDPTimeout(-1) = nil, want error")
+	}
+	if err := Start(testTunFd(t), "socks5://127.0.0.1:1080", "silent"); err != nil {
+		t.Fatal(err)
+	}
+	running := engineUDPTimeout
+	if err := SetUDPTimeout(30); err != nil {
+		t.Fatal(err)
+	}
+	if engineUDPTimeout != running {
+		t.Errorf("engine UDP timeout = %v while running, want %v kept", engineUDPTimeout, running)
+	}
+	lifecycleMu.Lock()
+	c := currentConfig()
+	lifecycleMu.Unlock()
+	if c.UDPTimeout != int(running/time.Second) {
+		t.Errorf("CurrentConfig udpTimeoutSeconds = %d, want the running %v", c.UDPTimeout, running)
+	}
+
+	Stop()
+	if err := Start(testTunFd(t), "socks5://127.0.0.1:1080", "silent"); err != nil {
+		t.Fatal(err)
+	}
+	if engineUDPTimeout != 30*time.Second {
+		t.Errorf("engine UDP timeout = %v after Start, want 30s", engineUDPTimeout)
+	}
+}
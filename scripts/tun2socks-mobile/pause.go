@@ -0,0 +1,49 @@
+package tun2socks
+
+import (
+	"github.com/xjasonlyu/tun2socks/v2/log"
+)
+
+// Pause stops forwarding packets without tearing anything down, e.g. for a
+// "pause VPN" button: the TUN fd stays open, so traffic cannot leak around
+// the tunnel, but packets from apps are read and dropped and nothing is
+// written back. Connections stall and eventually time out on their own.
+//
+// Running still reports true and Paused reports true until Resume or Stop.
+// The idle timeout does not run while paused. Pause is a no-op when the
+// engine is not running or already paused.
+func Pause() {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	s := currentSession
+	if s == nil || s.device.rw.paused.Swap(true) {
+		return
+	}
+	s.stopIdleWatch()
+	log.Infof("[MOBILE] paused")
+}
+
+// Resume restores forwarding after Pause, on the same engine and fd.
+// Connections that have not timed out meanwhile carry on. Resume is a
+// no-op when the engine is not paused.
+func Resume() {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	s := currentSession
+	if s == nil || !s.device.rw.paused.Swap(false) {
+		return
+	}
+	s.startIdleWatch()
+	log.Infof("[MOBILE] resumed")
+}
+
+// Paused reports whether the running engine is paused by Pause. A new
+// Start is never paused. Like Running, it is safe to call from any thread
+// and does not wait for a Start or Stop in progress.
+func Paused() bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return runningTun != nil && runningTun.paused.Load()
+}
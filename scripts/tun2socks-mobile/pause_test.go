@@ -0,0 +1,86 @@
+package tun2socks
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// rxPackets returns the packets the running netstack has read.
+func rxPackets() uint64 {
+	var n uint64
+	if s := activeStack.Load(); s != nil {
+		for _, info := range s.NICInfo() {
+			n += info.Stats.Rx.Packets.Value()
+		}
+	}
+	return n
+}
+
+func TestPauseResume(t *testing.T) {
+	defer Stop()
+
+	Pause() /* no-op when not running */
+	if Paused() {
+		t.Fatal("Paused() = true when not running")
+	}
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[1])
+	if err := Start(fds[0], "socks5://127.0.0.1:1080", "silent"); err != nil {
+		t.Fatal(err)
+	}
+	packet := make([]byte, 20)
+	packet[0] = 0x45 /* IPv4 */
+
+	Pause()
+	if !Running() || !Paused() {
+		t.Fatalf("Running() = %v, Paused() = %v after Pause, want both true", Running(), Paused())
+	}
+
+	// A Start or Stop in progress must not block it.
+	lifecycleMu.Lock()
+	paused := make(chan bool, 1)
+	go func() { paused <- Paused() }()
+	select {
+	case p := <-paused:
+		if !p {
+			t.Error("Paused() = false during a lifecycle call, want true")
+		}
+	case <-time.After(time.Second):
+		t.Error("Paused() waited for lifecycleMu")
+	}
+	lifecycleMu.Unlock()
+	if _, err := unix.Write(fds[1], packet); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := rxPackets(); n != 0 {
+		t.Errorf("netstack read %d packets while paused, want 0", n)
+	}
+
+	Resume()
+	if !Running() || Paused() {
+		t.Fatalf("Running() = %v, Paused() = %v after Resume, want true, false", Running(), Paused())
+	}
+	if _, err := unix.Write(fds[1], packet); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for rxPackets() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no packet read after Resume")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	Pause()
+	Stop()
+	if Paused() {
+		t.Error("Paused() = true after Stop")
+	}
+}
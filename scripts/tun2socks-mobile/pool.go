@@ -0,0 +1,159 @@
+package tun2socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/log"
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+	"github.com/xjasonlyu/tun2socks/v2/proxy/proto"
+)
+
+// poolEvictTime is how long a proxy that could not be reached is skipped.
+const poolEvictTime = 30 * time.Second
+
+// StartMulti is like Start but spreads new connections over several
+// proxies. gomobile cannot bind string slices, so proxyUrls is a
+// newline-separated list of proxy URLs; blank lines are ignored.
+//
+// Each new flow goes to the next proxy in round-robin order. If the proxy
+// itself cannot be reached (the connection to it fails, as opposed to the
+// proxy refusing the destination), the flow falls back to the following
+// one and the unreachable proxy is skipped for 30 seconds. When every
+// proxy is skipped, all are tried again.
+//
+// Restart replaces the whole list with a single proxy.
+func StartMulti(tunFd int, proxyUrls string, logLevel string) error {
+	var urls []string
+	for _, s := range strings.Split(proxyUrls, "\n") {
+		if s = strings.TrimSpace(s); s != "" {
+			urls = append(urls, s)
+		}
+	}
+	if len(urls) == 0 {
+		return errors.New("empty proxy list")
+	}
+	return start(&startParams{tunFd: tunFd, proxyUrl: urls[0], logLevel: logLevel, proxyUrls: urls})
+}
+
+// newUpstream validates the proxies of p and returns the one to dial
+// through: a proxyPool for several, or the proxy itself.
+func newUpstream(p *startParams) (proxy.Proxy, error) {
+	if len(p.proxyUrls) <= 1 {
+		if err := validateProxy(p.proxyUrl); err != nil {
+			return nil, err
+		}
+		return parseProxy(p.proxyUrl)
+	}
+	pool := &proxyPool{downUntil: make([]time.Time, len(p.proxyUrls))}
+	for _, s := range p.proxyUrls {
+		if err := validateProxy(s); err != nil {
+			return nil, err
+		}
+		px, _ := parseProxy(s)
+		pool.proxies = append(pool.proxies, px)
+	}
+	return pool, nil
+}
+
+// proxyPool is a proxy.Proxy dialing through several proxies round-robin.
+type proxyPool struct {
+	proxies []proxy.Proxy
+	next    atomic.Uint32
+
+	mu        sync.Mutex
+	downUntil []time.Time
+}
+
+var _ proxy.Proxy = (*proxyPool)(nil)
+
+func (p *proxyPool) Addr() string {
+	addrs := make([]string, len(p.proxies))
+	for i, px := range p.proxies {
+		addrs[i] = px.Addr()
+	}
+	return strings.Join(addrs, ",")
+}
+
+// Proto reports the protocol of the first proxy.
+func (p *proxyPool) Proto() proto.Proto {
+	return p.proxies[0].Proto()
+}
+
+func (p *proxyPool) DialContext(ctx context.Context, metadata *M.Metadata) (c net.Conn, err error) {
+	for _, i := range p.order() {
+		if c, err = p.proxies[i].DialContext(ctx, metadata); !p.failed(i, err) || ctx.Err() != nil {
+			return
+		}
+	}
+	return
+}
+
+func (p *proxyPool) DialUDP(metadata *M.Metadata) (pc net.PacketConn, err error) {
+	for _, i := range p.order() {
+		if pc, err = p.proxies[i].DialUDP(metadata); !p.failed(i, err) {
+			return
+		}
+	}
+	return
+}
+
+func (p *proxyPool) dialUDPContext(ctx context.Context, metadata *M.Metadata) (pc net.PacketConn, err error) {
+	for _, i := range p.order() {
+		if pc, err = dialUDPContext(ctx, p.proxies[i], metadata); !p.failed(i, err) || ctx.Err() != nil {
+			return
+		}
+	}
+	return
+}
+
+// order returns the proxies to try for a new flow: the healthy ones from
+// the next round-robin position on, or all of them if none is healthy.
+func (p *proxyPool) order() []int {
+	n := len(p.proxies)
+	first := int(p.next.Add(1)-1) % n
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var healthy, all []int
+	for k := 0; k < n; k++ {
+		i := (first + k) % n
+		all = append(all, i)
+		if now.After(p.downUntil[i]) {
+			healthy = append(healthy, i)
+		}
+	}
+	if len(healthy) == 0 {
+		return all
+	}
+	return healthy
+}
+
+// failed reports whether err means proxy i is unreachable, evicting it if
+// so.
+func (p *proxyPool) failed(i int, err error) bool {
+	if !proxyUnreachable(err) {
+		return false
+	}
+	p.mu.Lock()
+	p.downUntil[i] = time.Now().Add(poolEvictTime)
+	p.mu.Unlock()
+	log.Warnf("[MOBILE] proxy %s unreachable, skipping for %v: %v", p.proxies[i].Addr(), poolEvictTime, err)
+	return true
+}
+
+// proxyUnreachable reports whether a dial error means the proxy itself
+// could not be reached. Errors from the proxy's reply are the
+// destination's fault.
+func proxyUnreachable(err error) bool {
+	var opErr *net.OpError
+	return err != nil && errors.As(err, &opErr) && opErr.Op == "dial"
+}
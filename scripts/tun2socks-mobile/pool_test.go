@@ -0,0 +1,69 @@
+package tun2socks
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+)
+
+func newTestPool(proxies ...proxy.Proxy) *proxyPool {
+	return &proxyPool{proxies: proxies, downUntil: make([]time.Time, len(proxies))}
+}
+
+func TestProxyPoolRoundRobin(t *testing.T) {
+	p := newTestPool(proxy.NewDirect(), proxy.NewDirect(), proxy.NewDirect())
+	for _, want := range []int{0, 1, 2, 0} {
+		if got := p.order()[0]; got != want {
+			t.Errorf("order()[0] = %d, want %d", got, want)
+		}
+	}
+}
+
+func TestProxyPoolFallback(t *testing.T) {
+	// A port nothing listens on stands in for a proxy that is down.
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	down, _ := proxy.NewSocks5(deadAddr, "", "")
+	p := newTestPool(down, proxy.NewDirect())
+
+	addr := target.Addr().(*net.TCPAddr)
+	metadata := &M.Metadata{Network: M.TCP, DstIP: addr.IP, DstPort: uint16(addr.Port)}
+	c, err := p.DialContext(context.Background(), metadata)
+	if err != nil {
+		t.Fatalf("DialContext = %v, want fallback to the second proxy", err)
+	}
+	c.Close()
+
+	// The unreachable proxy is skipped from now on.
+	for i := 0; i < 2; i++ {
+		if got := p.order(); !reflect.DeepEqual(got, []int{1}) {
+			t.Errorf("order() = %v, want [1]", got)
+		}
+	}
+}
+
+func TestStartMultiInvalid(t *testing.T) {
+	fd := testTunFd(t)
+	for _, urls := range []string{"", "\n \n", "socks5://127.0.0.1:1080\nftp://x:1"} {
+		if err := StartMulti(fd, urls, "silent"); err == nil {
+			Stop()
+			t.Errorf("StartMulti(%q) = nil, want error", urls)
+		}
+	}
+}
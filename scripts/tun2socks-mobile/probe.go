@@ -0,0 +1,151 @@
+package tun2socks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+)
+
+// defaultProbeAddr is the destination requested through the proxy by
+// StartChecked unless SetProbeAddress overrides it.
+const defaultProbeAddr = "1.1.1.1:443"
+
+// StartChecked is like Start but first verifies the proxy accepts
+// connections: it asks the proxy to connect to the probe address (a SOCKS5
+// handshake, HTTP CONNECT, etc.) and fails if that does not succeed within
+// probeTimeoutMs. On success it proceeds exactly like Start.
+func StartChecked(tunFd int, proxyUrl, logLevel string, probeTimeoutMs int) error {
+	if probeTimeoutMs <= 0 {
+		return fmt.Errorf("invalid probe timeout: %d", probeTimeoutMs)
+	}
+	if err := validateFd(tunFd); err != nil {
+		return err
+	}
+	if err := validateProxy(proxyUrl); err != nil {
+		return err
+	}
+	p, _ := parseProxy(proxyUrl)
+
+	lifecycleMu.Lock()
+	addr := options.probeAddr
+	lifecycleMu.Unlock()
+
+	if err := probeProxy(p, addr, time.Duration(probeTimeoutMs)*time.Millisecond); err != nil {
+		return fmt.Errorf("proxy health check: %w", err)
+	}
+	return Start(tunFd, proxyUrl, logLevel)
+}
+
+// SetProbeAddress sets the "ip:port" destination StartChecked connects to
+// through the proxy. An empty string restores the default, 1.1.1.1:443.
+func SetProbeAddress(address string) error {
+	if address != "" {
+		if _, _, err := splitIPPort(address); err != nil {
+			return err
+		}
+	}
+
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	options.probeAddr = address
+	return nil
+}
+
+// probeProxy opens and closes a TCP connection to addr through p. It gives
+// up after timeout even if the proxy stalls mid-handshake.
+func probeProxy(p proxy.Proxy, addr string, timeout time.Duration) error {
+	if addr == "" {
+		addr = defaultProbeAddr
+	}
+	ip, port, err := splitIPPort(addr)
+	if err != nil {
+		return err
+	}
+	metadata := &M.Metadata{Network: M.TCP, DstIP: ip, DstPort: port}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	c, err := dialWithin(ctx, p, metadata)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("no response from %s://%s within %v", p.Proto(), p.Addr(), timeout)
+	}
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+// MeasureLatency returns the time in milliseconds to open a connection to
+// host:port through the running engine's proxy, including the proxy
+// handshake, e.g. for a "ping" button. Unlike StartChecked it measures the
+// live tunnel and can be called repeatedly.
+//
+// host may be an IP or a name. A name is passed to the proxy, which
+// resolves it as for a domain flow, so the result includes that lookup.
+// An error is returned if the engine is not running or timeoutMs elapses.
+func MeasureLatency(host string, port int, timeoutMs int) (int, error) {
+	if port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port: %d", port)
+	}
+	if timeoutMs <= 0 {
+		return 0, fmt.Errorf("invalid timeout: %d", timeoutMs)
+	}
+
+	lifecycleMu.Lock()
+	var p proxy.Proxy
+	if currentSession != nil {
+		p = currentSession.upstream
+	}
+	lifecycleMu.Unlock()
+	if p == nil {
+		return 0, errors.New("not running")
+	}
+
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	metadata := &M.Metadata{Network: M.TCP, DstIP: net.ParseIP(strings.Trim(host, "[]")), DstPort: uint16(port)}
+	if metadata.DstIP == nil {
+		metadata.DstIP = net.IPv4zero
+		ctx = withDestHost(ctx, host)
+	}
+
+	start := time.Now()
+	c, err := dialWithin(ctx, p, metadata)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return 0, fmt.Errorf("no response from %s within %v", destAddress(ctx, metadata), timeout)
+	}
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	c.Close()
+	return int(rtt.Milliseconds()), nil
+}
+
+// splitIPPort parses an "ip:port" address.
+func splitIPPort(addr string) (net.IP, uint16, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("invalid address %q: host must be an IP", addr)
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || n == 0 {
+		return nil, 0, fmt.Errorf("invalid address %q: bad port", addr)
+	}
+	return ip, uint16(n), nil
+}
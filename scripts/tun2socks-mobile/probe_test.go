@@ -0,0 +1,80 @@
+package tun2socks
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMeasureLatency(t *testing.T) {
+	if _, err := MeasureLatency("127.0.0.1", 80, 100); err == nil {
+		t.Error("MeasureLatency = nil error when not running")
+	}
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	port := target.Addr().(*net.TCPAddr).Port
+
+	// A proxy that accepts but never answers the CONNECT.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	defer Stop()
+	if err := Start(testTunFd(t), "direct://", "silent"); err != nil {
+		t.Fatal(err)
+	}
+	if ms, err := MeasureLatency("localhost", port, 1000); err != nil || ms < 0 {
+		t.Errorf("MeasureLatency = %d, %v", ms, err)
+	}
+
+	if err := Restart("http://" + silent.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	_, err = MeasureLatency("127.0.0.1", port, 100)
+	if err == nil || !strings.Contains(err.Error(), "no response") {
+		t.Errorf("MeasureLatency via silent proxy = %v, want timeout", err)
+	}
+
+	// A name goes to the proxy as is, not resolved on the device.
+	targets := make(chan string, 1)
+	connect, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connect.Close()
+	go func() {
+		c, err := connect.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			return
+		}
+		targets <- req.Host
+		c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	}()
+	if err := Restart("http://" + connect.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MeasureLatency("unresolvable.invalid", 443, 1000); err != nil {
+		t.Errorf("MeasureLatency(name) = %v", err)
+	}
+	select {
+	case got := <-targets:
+		if got != "unresolvable.invalid:443" {
+			t.Errorf("CONNECT %s, want unresolvable.invalid:443", got)
+		}
+	default:
+		t.Error("no CONNECT reached the proxy")
+	}
+}
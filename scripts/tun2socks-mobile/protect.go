@@ -0,0 +1,106 @@
+package tun2socks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/xjasonlyu/tun2socks/v2/dialer"
+)
+
+// ProtectCallback lets the app exclude the engine's own sockets from the
+// VPN, typically by calling VpnService.protect(fd). Protect returns false
+// if that failed, which fails the connection rather than letting it loop
+// back into the tunnel.
+type ProtectCallback interface {
+	Protect(fd int) bool
+}
+
+type protectHolder struct{ p ProtectCallback }
+
+var protectCallback atomic.Pointer[protectHolder]
+
+// SetProtectCallback registers p for every TCP and UDP socket the engine
+// dials itself: connections to the proxy (including SOCKS5 UDP relays),
+// bypassed and direct flows, and the StartChecked/StartAutoMTU probes.
+// nil removes it. It takes effect for sockets created afterwards.
+//
+// Protect is called synchronously on the dialing goroutine, right after
+// the socket is created and before it is bound or connected, so no packet
+// is sent before the app has protected it. Keep it fast: every new flow
+// waits for it.
+//
+// Hostname lookups, for a proxy or a direct flow given by name, go through
+// the system resolver and its sockets are not passed to p: Go's own
+// resolver does not work on Android. Give the proxy as an IP address, or
+// exclude the app with addDisallowedApplication(), if those lookups must
+// not enter the tunnel. Apps excluded that way do not need a callback at
+// all.
+func SetProtectCallback(p ProtectCallback) {
+	if p == nil {
+		protectCallback.Store(nil)
+		return
+	}
+	protectCallback.Store(&protectHolder{p: p})
+}
+
+// protectedDial dials like the engine's dialer package, but through
+// controlSocket.
+func protectedDial(ctx context.Context, network, address string) (net.Conn, error) {
+	d := net.Dialer{Control: controlSocket}
+	return d.DialContext(ctx, network, address)
+}
+
+// protectedListenPacket is protectedDial for unconnected UDP sockets.
+func protectedListenPacket(network, address string) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: controlSocket}
+	return lc.ListenPacket(context.Background(), network, address)
+}
+
+// controlSocket protects a new TCP or UDP socket and applies the engine's
+// outbound interface and routing mark to it, as the engine's own dialer
+// does.
+func controlSocket(network, address string, c syscall.RawConn) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return nil
+	}
+
+	var innerErr error
+	err := c.Control(func(fd uintptr) {
+		if h := protectCallback.Load(); h != nil && !h.p.Protect(int(fd)) {
+			innerErr = fmt.Errorf("protect socket for %s: rejected by app", address)
+			return
+		}
+
+		host, _, _ := net.SplitHostPort(address)
+		if ip := net.ParseIP(host); ip != nil && !ip.IsGlobalUnicast() {
+			return
+		}
+		name := dialer.DefaultInterfaceName.Load()
+		if name == "" {
+			if index := int(dialer.DefaultInterfaceIndex.Load()); index != 0 {
+				if iface, err := net.InterfaceByIndex(index); err == nil {
+					name = iface.Name
+				}
+			}
+		}
+		if name != "" {
+			if innerErr = unix.BindToDevice(int(fd), name); innerErr != nil {
+				return
+			}
+		}
+		if mark := int(dialer.DefaultRoutingMark.Load()); mark != 0 {
+			innerErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+		}
+	})
+	if innerErr != nil {
+		return innerErr
+	}
+	return err
+}
@@ -0,0 +1,53 @@
+package tun2socks
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+)
+
+type protectFunc func(fd int) bool
+
+func (f protectFunc) Protect(fd int) bool { return f(fd) }
+
+func TestProtectCallback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().(*net.TCPAddr)
+	metadata := &M.Metadata{Network: M.TCP, DstIP: addr.IP, DstPort: uint16(addr.Port)}
+
+	var fds []int
+	SetProtectCallback(protectFunc(func(fd int) bool {
+		fds = append(fds, fd)
+		return true
+	}))
+	defer SetProtectCallback(nil)
+
+	p, _ := parseProxy("socks5://" + ln.Addr().String())
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	// The handshake fails against a plain listener; the socket is
+	// protected before that.
+	p.DialContext(context.Background(), metadata)
+	if len(fds) != 1 || fds[0] <= 0 {
+		t.Errorf("Protect calls = %v, want one with a valid fd", fds)
+	}
+
+	SetProtectCallback(protectFunc(func(int) bool { return false }))
+	if c, err := newDirect().DialContext(context.Background(), metadata); err == nil {
+		c.Close()
+		t.Error("DialContext = nil error with a rejecting Protect")
+	}
+	if pc, err := newDirect().DialUDP(metadata); err == nil {
+		pc.Close()
+		t.Error("DialUDP = nil error with a rejecting Protect")
+	}
+}
@@ -0,0 +1,439 @@
+package tun2socks
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Dreamacro/go-shadowsocks2/core"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+	"github.com/xjasonlyu/tun2socks/v2/proxy/proto"
+	obfs "github.com/xjasonlyu/tun2socks/v2/transport/simple-obfs"
+	"github.com/xjasonlyu/tun2socks/v2/transport/socks4"
+	"github.com/xjasonlyu/tun2socks/v2/transport/socks5"
+)
+
+// The proxies below follow the engine's proxy package, which dials through
+// its dialer package with no way to reach a socket before it connects.
+// These dial through protectedDial instead, so SetProtectCallback covers
+// every socket the engine opens, though not those of the system resolver.
+
+const (
+	tcpKeepAlivePeriod = 30 * time.Second
+
+	// udpAssociateTimeout bounds the TCP control connection of a SOCKS5
+	// UDP association dialed without a context, like the engine's connect
+	// timeout.
+	udpAssociateTimeout = 5 * time.Second
+)
+
+// udpContextDialer is implemented by the proxies whose DialUDP has a
+// handshake to bound, so the dispatcher can apply the dial timeout to it.
+type udpContextDialer interface {
+	dialUDPContext(ctx context.Context, metadata *M.Metadata) (net.PacketConn, error)
+}
+
+// dialUDPContext dials a UDP flow through p, bounded by ctx where p
+// supports it.
+func dialUDPContext(ctx context.Context, p proxy.Proxy, metadata *M.Metadata) (net.PacketConn, error) {
+	if u, ok := p.(udpContextDialer); ok {
+		return u.dialUDPContext(ctx, metadata)
+	}
+	return p.DialUDP(metadata)
+}
+
+type base struct {
+	addr  string
+	proto proto.Proto
+}
+
+func (b *base) Addr() string       { return b.addr }
+func (b *base) Proto() proto.Proto { return b.proto }
+
+var (
+	_ proxy.Proxy = (*directProxy)(nil)
+	_ proxy.Proxy = (*httpProxy)(nil)
+	_ proxy.Proxy = (*socks4Proxy)(nil)
+	_ proxy.Proxy = (*socks5Proxy)(nil)
+	_ proxy.Proxy = (*ssProxy)(nil)
+)
+
+type directProxy struct{ base }
+
+func newDirect() *directProxy {
+	return &directProxy{base{proto: proto.Direct}}
+}
+
+func (d *directProxy) DialContext(ctx context.Context, metadata *M.Metadata) (net.Conn, error) {
+	c, err := protectedDial(ctx, "tcp", destAddress(ctx, metadata))
+	if err != nil {
+		return nil, err
+	}
+	setKeepAlive(c)
+	return c, nil
+}
+
+func (d *directProxy) DialUDP(*M.Metadata) (net.PacketConn, error) {
+	pc, err := protectedListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	return &directPacketConn{PacketConn: pc}, nil
+}
+
+type directPacketConn struct {
+	net.PacketConn
+}
+
+func (pc *directPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return pc.PacketConn.WriteTo(b, udpAddr)
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr.String())
+	if err != nil {
+		return 0, err
+	}
+	return pc.PacketConn.WriteTo(b, udpAddr)
+}
+
+type httpProxy struct {
+	base
+	user, pass string
+}
+
+func (h *httpProxy) DialContext(ctx context.Context, metadata *M.Metadata) (c net.Conn, err error) {
+	c, err = protectedDial(ctx, "tcp", h.addr)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", h.addr, err)
+	}
+	setKeepAlive(c)
+	defer func() {
+		if err != nil {
+			c.Close()
+		}
+	}()
+
+	err = h.shakeHand(destAddress(ctx, metadata), c)
+	return
+}
+
+func (h *httpProxy) DialUDP(*M.Metadata) (net.PacketConn, error) {
+	return nil, errors.New("not supported")
+}
+
+func (h *httpProxy) shakeHand(addr string, rw io.ReadWriter) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: addr},
+		Host:   addr,
+		Header: http.Header{
+			"Proxy-Connection": []string{"Keep-Alive"},
+		},
+	}
+	if h.user != "" && h.pass != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(h.user + ":" + h.pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(rw); err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(rw), req)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusProxyAuthRequired:
+		return errors.New("HTTP auth required by proxy")
+	case http.StatusMethodNotAllowed:
+		return errors.New("CONNECT method not allowed by proxy")
+	default:
+		return fmt.Errorf("HTTP connect status: %s", resp.Status)
+	}
+}
+
+type socks4Proxy struct {
+	base
+	userID string
+}
+
+func (ss *socks4Proxy) DialContext(ctx context.Context, metadata *M.Metadata) (c net.Conn, err error) {
+	c, err = protectedDial(ctx, "tcp", ss.addr)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", ss.addr, err)
+	}
+	setKeepAlive(c)
+	defer func() {
+		if err != nil {
+			c.Close()
+		}
+	}()
+
+	err = socks4.ClientHandshake(c, destAddress(ctx, metadata), socks4.CmdConnect, ss.userID)
+	return
+}
+
+func (ss *socks4Proxy) DialUDP(*M.Metadata) (net.PacketConn, error) {
+	return nil, errors.New("not supported")
+}
+
+type socks5Proxy struct {
+	base
+	user, pass string
+
+	// unix indicates socks5 over a unix domain socket.
+	unix bool
+}
+
+func newSocks5(addr, user, pass string) *socks5Proxy {
+	return &socks5Proxy{
+		base: base{addr: addr, proto: proto.Socks5},
+		user: user,
+		pass: pass,
+		unix: len(addr) > 0 && addr[0] == '/',
+	}
+}
+
+func (ss *socks5Proxy) socksUser() *socks5.User {
+	if ss.user == "" {
+		return nil
+	}
+	return &socks5.User{Username: ss.user, Password: ss.pass}
+}
+
+func (ss *socks5Proxy) DialContext(ctx context.Context, metadata *M.Metadata) (c net.Conn, err error) {
+	network := "tcp"
+	if ss.unix {
+		network = "unix"
+	}
+	c, err = protectedDial(ctx, network, ss.addr)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", ss.addr, err)
+	}
+	setKeepAlive(c)
+	defer func() {
+		if err != nil {
+			c.Close()
+		}
+	}()
+
+	_, err = socks5.ClientHandshake(c, destSocksAddr(ctx, metadata), socks5.CmdConnect, ss.socksUser())
+	return
+}
+
+func (ss *socks5Proxy) DialUDP(metadata *M.Metadata) (net.PacketConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), udpAssociateTimeout)
+	defer cancel()
+	return ss.dialUDPContext(ctx, metadata)
+}
+
+func (ss *socks5Proxy) dialUDPContext(ctx context.Context, _ *M.Metadata) (_ net.PacketConn, err error) {
+	if ss.unix {
+		return nil, errors.New("not supported when unix domain socket is enabled")
+	}
+
+	c, err := protectedDial(ctx, "tcp", ss.addr)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", ss.addr, err)
+	}
+	setKeepAlive(c)
+	defer func() {
+		if err != nil {
+			c.Close()
+		}
+	}()
+
+	// Per RFC 1928, a client that does not know the address it will send
+	// from uses all zeros.
+	var targetAddr socks5.Addr = []byte{socks5.AtypIPv4, 0, 0, 0, 0, 0, 0}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	addr, err := socks5.ClientHandshake(c, targetAddr, socks5.CmdUDPAssociate, ss.socksUser())
+	if err != nil {
+		return nil, fmt.Errorf("client handshake: %w", err)
+	}
+	c.SetDeadline(time.Time{})
+
+	bindAddr := addr.UDPAddr()
+	if bindAddr == nil {
+		return nil, fmt.Errorf("invalid UDP binding address: %#v", addr)
+	}
+	if bindAddr.IP.IsUnspecified() { /* e.g. "0.0.0.0" or "::" */
+		udpAddr, err := net.ResolveUDPAddr("udp", ss.addr)
+		if err != nil {
+			return nil, fmt.Errorf("resolve udp address %s: %w", ss.addr, err)
+		}
+		bindAddr.IP = udpAddr.IP
+	}
+
+	pc, err := protectedListenPacket("udp", "")
+	if err != nil {
+		return nil, fmt.Errorf("listen packet: %w", err)
+	}
+	go func() {
+		// The association ends with the TCP connection it was made on.
+		io.Copy(io.Discard, c)
+		c.Close()
+		pc.Close()
+	}()
+	return &socksPacketConn{PacketConn: pc, rAddr: bindAddr, tcpConn: c}, nil
+}
+
+type socksPacketConn struct {
+	net.PacketConn
+
+	rAddr   net.Addr
+	tcpConn net.Conn
+}
+
+func (pc *socksPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	packet, err := socks5.EncodeUDPPacket(socksAddr(addr), b)
+	if err != nil {
+		return 0, err
+	}
+	return pc.PacketConn.WriteTo(packet, pc.rAddr)
+}
+
+func (pc *socksPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, _, err := pc.PacketConn.ReadFrom(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	addr, payload, err := socks5.DecodeUDPPacket(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	udpAddr := addr.UDPAddr()
+	if udpAddr == nil {
+		return 0, nil, fmt.Errorf("convert %s to UDPAddr is nil", addr)
+	}
+	// DecodeUDPPacket works in place; take the length before copying.
+	copy(b, payload)
+	return n - len(addr) - 3, udpAddr, nil
+}
+
+func (pc *socksPacketConn) Close() error {
+	pc.tcpConn.Close()
+	return pc.PacketConn.Close()
+}
+
+type ssProxy struct {
+	base
+	cipher core.Cipher
+
+	// simple-obfs plugin
+	obfsMode, obfsHost string
+}
+
+func newShadowsocks(addr, method, password, obfsMode, obfsHost string) (*ssProxy, error) {
+	cipher, err := core.PickCipher(method, nil, password)
+	if err != nil {
+		return nil, fmt.Errorf("ss initialize: %w", err)
+	}
+	return &ssProxy{
+		base:     base{addr: addr, proto: proto.Shadowsocks},
+		cipher:   cipher,
+		obfsMode: obfsMode,
+		obfsHost: obfsHost,
+	}, nil
+}
+
+func (ss *ssProxy) DialContext(ctx context.Context, metadata *M.Metadata) (c net.Conn, err error) {
+	c, err = protectedDial(ctx, "tcp", ss.addr)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", ss.addr, err)
+	}
+	setKeepAlive(c)
+	defer func() {
+		if err != nil {
+			c.Close()
+		}
+	}()
+
+	switch ss.obfsMode {
+	case "tls":
+		c = obfs.NewTLSObfs(c, ss.obfsHost)
+	case "http":
+		_, port, _ := net.SplitHostPort(ss.addr)
+		c = obfs.NewHTTPObfs(c, ss.obfsHost, port)
+	}
+	c = ss.cipher.StreamConn(c)
+	_, err = c.Write(destSocksAddr(ctx, metadata))
+	return
+}
+
+func (ss *ssProxy) DialUDP(*M.Metadata) (net.PacketConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", ss.addr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve udp address %s: %w", ss.addr, err)
+	}
+	pc, err := protectedListenPacket("udp", "")
+	if err != nil {
+		return nil, fmt.Errorf("listen packet: %w", err)
+	}
+	return &ssPacketConn{PacketConn: ss.cipher.PacketConn(pc), rAddr: udpAddr}, nil
+}
+
+type ssPacketConn struct {
+	net.PacketConn
+
+	rAddr net.Addr
+}
+
+func (pc *ssPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	packet, err := socks5.EncodeUDPPacket(socksAddr(addr), b)
+	if err != nil {
+		return 0, err
+	}
+	// Shadowsocks packets are SOCKS5 UDP packets without RSV and FRAG.
+	return pc.PacketConn.WriteTo(packet[3:], pc.rAddr)
+}
+
+func (pc *ssPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, _, err := pc.PacketConn.ReadFrom(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	addr := socks5.SplitAddr(b[:n])
+	if addr == nil {
+		return 0, nil, errors.New("parse addr error")
+	}
+	udpAddr := addr.UDPAddr()
+	if udpAddr == nil {
+		return 0, nil, errors.New("parse addr error")
+	}
+	copy(b, b[len(addr):])
+	return n - len(addr), udpAddr, nil
+}
+
+// socksAddr encodes a packet destination. The engine passes *M.Addr, which
+// carries the flow's metadata.
+func socksAddr(addr net.Addr) socks5.Addr {
+	if ma, ok := addr.(*M.Addr); ok {
+		return serializeSocksAddr(ma.Metadata())
+	}
+	return socks5.ParseAddr(addr)
+}
+
+func serializeSocksAddr(m *M.Metadata) socks5.Addr {
+	return socks5.SerializeAddr("", m.DstIP, m.DstPort)
+}
+
+func setKeepAlive(c net.Conn) {
+	if tcp, ok := c.(*net.TCPConn); ok {
+		tcp.SetKeepAlive(true)
+		tcp.SetKeepAlivePeriod(tcpKeepAlivePeriod)
+	}
+}
@@ -0,0 +1,198 @@
+package tun2socks
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+	"github.com/xjasonlyu/tun2socks/v2/proxy/proto"
+)
+
+// supportedSchemes lists the proxy URL schemes understood by the engine,
+// one per protocol of the linked proxy/proto package.
+var supportedSchemes = protoSchemes()
+
+// protoSchemes returns the names of the engine's protocols. proto.Proto
+// values are consecutive from 0, and String names unknown ones "proto(N)".
+func protoSchemes() []string {
+	var schemes []string
+	for p := proto.Proto(0); ; p++ {
+		name := p.String()
+		if strings.HasPrefix(name, "proto(") {
+			return schemes
+		}
+		schemes = append(schemes, name)
+	}
+}
+
+// validateProxy checks proxyUrl has a supported scheme and can be turned
+// into a proxy.
+func validateProxy(proxyUrl string) error {
+	if proxyUrl == "" {
+		return errors.New("empty proxy url")
+	}
+	u, err := parseProxyURL(proxyUrl)
+	if err != nil {
+		return fmt.Errorf("invalid proxy url: %w", err)
+	}
+	scheme := strings.ToLower(u.Scheme)
+	for _, s := range supportedSchemes {
+		if scheme == s {
+			if err := validateProxyHost(u); err != nil {
+				return err
+			}
+			// Parse it fully here, so a bad proxy fails before the
+			// engine touches the TUN fd.
+			if _, err := parseProxy(proxyUrl); err != nil {
+				return fmt.Errorf("invalid proxy url: %w", err)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported proxy scheme %q (supported: %s)",
+		u.Scheme, strings.Join(supportedSchemes, ", "))
+}
+
+// validateProxyHost checks the proxy address is a host:port pair. IPv6
+// literals must be bracketed, e.g. "socks5://[2001:db8::1]:1080"; they are
+// passed to the engine unchanged.
+func validateProxyHost(u *url.URL) error {
+	switch strings.ToLower(u.Scheme) {
+	case proto.Direct.String(), proto.Reject.String():
+		return nil
+	case proto.Socks5.String():
+		if u.Host == "" && u.Path != "" {
+			return nil /* socks5 over UDS */
+		}
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return fmt.Errorf("invalid proxy address %q: %w", u.Host, err)
+	}
+	if host == "" || port == "" {
+		return fmt.Errorf("invalid proxy address %q: missing host or port", u.Host)
+	}
+	return nil
+}
+
+// socks5URL builds a SOCKS5 proxy URL with the credentials escaped, so
+// passwords containing '@', ':' or '/' survive parsing. An empty username
+// omits the credentials.
+func socks5URL(host string, port int, username, password string) (string, error) {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "" {
+		return "", errors.New("empty proxy host")
+	}
+	if port <= 0 || port > 65535 {
+		return "", fmt.Errorf("invalid proxy port: %d", port)
+	}
+
+	u := &url.URL{
+		Scheme: proto.Socks5.String(),
+		Host:   net.JoinHostPort(host, strconv.Itoa(port)),
+	}
+	if username != "" {
+		u.User = url.UserPassword(username, password)
+	}
+	return u.String(), nil
+}
+
+// parseProxy builds a proxy.Proxy from a URL the same way the engine does
+// in engine/parse.go, which is not exported, but with the wrapper's own
+// proxy implementations from proxies.go.
+func parseProxy(s string) (proxy.Proxy, error) {
+	u, err := parseProxyURL(s)
+	if err != nil {
+		return nil, err
+	}
+
+	password, _ := u.User.Password()
+	switch protocol := strings.ToLower(u.Scheme); protocol {
+	case proto.Direct.String():
+		return newDirect(), nil
+	case proto.Reject.String():
+		return proxy.NewReject(), nil
+	case proto.HTTP.String():
+		return &httpProxy{base: base{addr: u.Host, proto: proto.HTTP}, user: u.User.Username(), pass: password}, nil
+	case proto.Socks4.String():
+		return &socks4Proxy{base: base{addr: u.Host, proto: proto.Socks4}, userID: u.User.Username()}, nil
+	case proto.Socks5.String():
+		address := u.Host
+		if address == "" {
+			address = u.Path /* socks5 over UDS */
+		}
+		return newSocks5(address, u.User.Username(), password), nil
+	case proto.Shadowsocks.String():
+		return newShadowsocks(parseShadowsocks(u))
+	default:
+		return nil, fmt.Errorf("unsupported protocol: %s", protocol)
+	}
+}
+
+// parseProxyURL parses a proxy URL, also accepting the legacy Shadowsocks
+// form with everything but the scheme base64-encoded:
+// "ss://" + base64("method:password@host:port").
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || !strings.EqualFold(u.Scheme, proto.Shadowsocks.String()) || u.User != nil {
+		return u, err
+	}
+	// Standard base64 may contain '/', so take the blob from s rather than
+	// from u.Host.
+	blob, _, _ := strings.Cut(s[len(u.Scheme)+len("://"):], "#")
+	blob, _, _ = strings.Cut(blob, "?")
+	data, err := decodeBase64(blob)
+	if err != nil || !strings.Contains(string(data), "@") {
+		return u, nil
+	}
+	legacy, err := url.Parse("ss://" + string(data))
+	if err != nil {
+		return nil, err
+	}
+	legacy.RawQuery, legacy.Fragment = u.RawQuery, u.Fragment
+	return legacy, nil
+}
+
+// decodeBase64 decodes base64 in the URL or standard alphabet, padded or
+// not, as Shadowsocks clients produce all of them.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	s = strings.NewReplacer("+", "-", "/", "_").Replace(s)
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+func parseShadowsocks(u *url.URL) (address, method, password, obfsMode, obfsHost string) {
+	address = u.Host
+
+	if pass, set := u.User.Password(); set {
+		method = u.User.Username()
+		password = pass
+	} else {
+		data, _ := decodeBase64(u.User.String())
+		userInfo := strings.SplitN(string(data), ":", 2)
+		if len(userInfo) == 2 {
+			method = userInfo[0]
+			password = userInfo[1]
+		}
+	}
+
+	rawQuery, _ := url.QueryUnescape(u.RawQuery)
+	for _, s := range strings.Split(rawQuery, ";") {
+		data := strings.SplitN(s, "=", 2)
+		if len(data) != 2 {
+			continue
+		}
+		switch data[0] {
+		case "obfs":
+			obfsMode = data[1]
+		case "obfs-host":
+			obfsHost = data[1]
+		}
+	}
+	return
+}
@@ -0,0 +1,191 @@
+package tun2socks
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy/proto"
+)
+
+func TestValidateProxyIPv6(t *testing.T) {
+	tests := []struct {
+		url  string
+		addr string
+	}{
+		{"socks5://[2001:db8::1]:1080", "[2001:db8::1]:1080"},
+		{"socks5://user:pass@[2001:db8::1]:1080", "[2001:db8::1]:1080"},
+		{"http://user:p%40ss@[::1]:8080", "[::1]:8080"},
+	}
+	for _, tt := range tests {
+		if err := validateProxy(tt.url); err != nil {
+			t.Errorf("validateProxy(%q) = %v", tt.url, err)
+			continue
+		}
+		p, err := parseProxy(tt.url)
+		if err != nil {
+			t.Errorf("parseProxy(%q) = %v", tt.url, err)
+			continue
+		}
+		if p.Addr() != tt.addr {
+			t.Errorf("parseProxy(%q).Addr() = %q, want %q", tt.url, p.Addr(), tt.addr)
+		}
+		if key := newKey(&startParams{tunFd: 3, proxyUrl: tt.url, logLevel: "info", mtu: defaultMTU}); key.Proxy != tt.url {
+			t.Errorf("key.Proxy = %q, want %q", key.Proxy, tt.url)
+		}
+	}
+}
+
+func TestValidateProxyInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"socks5://2001:db8::1:1080",
+		"socks5://1.2.3.4",
+		"ftp://1.2.3.4:21",
+	} {
+		if err := validateProxy(s); err == nil {
+			t.Errorf("validateProxy(%q) = nil, want error", s)
+		}
+	}
+}
+
+func TestSocks5URLEscapesCredentials(t *testing.T) {
+	tests := []struct {
+		host     string
+		username string
+		password string
+		addr     string
+	}{
+		{"1.2.3.4", "user", "p@ss:w/rd", "1.2.3.4:1080"},
+		{"2001:db8::1", "u:ser", "@:/", "[2001:db8::1]:1080"},
+		{"proxy.example.com", "", "", "proxy.example.com:1080"},
+	}
+	for _, tt := range tests {
+		s, err := socks5URL(tt.host, 1080, tt.username, tt.password)
+		if err != nil {
+			t.Fatalf("socks5URL(%q) = %v", tt.host, err)
+		}
+		if err := validateProxy(s); err != nil {
+			t.Errorf("validateProxy(%q) = %v", s, err)
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatalf("url.Parse(%q) = %v", s, err)
+		}
+		password, _ := u.User.Password()
+		if u.Host != tt.addr || u.User.Username() != tt.username || password != tt.password {
+			t.Errorf("socks5URL round trip = %q %q %q, want %q %q %q",
+				u.Host, u.User.Username(), password, tt.addr, tt.username, tt.password)
+		}
+		if tt.username == "" && u.User != nil {
+			t.Errorf("socks5URL(%q) has credentials, want none", tt.host)
+		}
+	}
+}
+
+func TestSocks5URLInvalid(t *testing.T) {
+	if _, err := socks5URL("", 1080, "", ""); err == nil {
+		t.Error("socks5URL with empty host = nil error")
+	}
+	if _, err := socks5URL("1.2.3.4", 70000, "", ""); err == nil {
+		t.Error("socks5URL with port 70000 = nil error")
+	}
+}
+
+func TestSupportedSchemes(t *testing.T) {
+	want := []string{"direct", "reject", "http", "socks4", "socks5", "ss"}
+	if !reflect.DeepEqual(supportedSchemes, want) {
+		t.Errorf("supportedSchemes = %v, want %v", supportedSchemes, want)
+	}
+	err := validateProxy("vmess://1.2.3.4:443")
+	if err == nil || !strings.Contains(err.Error(), `unsupported proxy scheme "vmess"`) {
+		t.Errorf("validateProxy(vmess) = %v, want unsupported scheme error", err)
+	}
+}
+
+func TestShadowsocksURL(t *testing.T) {
+	userinfo := base64.RawURLEncoding.EncodeToString([]byte("aes-256-gcm:pa$$:word"))
+	legacy := base64.StdEncoding.EncodeToString([]byte("chacha20-ietf-poly1305:secret@[2001:db8::1]:8388"))
+	tests := []struct {
+		url  string
+		addr string
+	}{
+		// SIP002 with plain credentials.
+		{"ss://aes-128-gcm:secret@1.2.3.4:8388", "1.2.3.4:8388"},
+		// SIP002 with base64url userinfo and a plugin.
+		{"ss://" + userinfo + "@1.2.3.4:8388/?obfs%3Dtls%3Bobfs-host%3Dexample.com#name", "1.2.3.4:8388"},
+		// Legacy form with the whole URL base64-encoded.
+		{"ss://" + legacy + "#name", "[2001:db8::1]:8388"},
+	}
+	for _, tt := range tests {
+		if err := validateProxy(tt.url); err != nil {
+			t.Errorf("validateProxy(%q) = %v", tt.url, err)
+			continue
+		}
+		p, _ := parseProxy(tt.url)
+		if p.Proto() != proto.Shadowsocks || p.Addr() != tt.addr {
+			t.Errorf("parseProxy(%q) = %v %s, want ss %s", tt.url, p.Proto(), p.Addr(), tt.addr)
+		}
+		if key := newKey(&startParams{tunFd: 3, proxyUrl: tt.url, logLevel: "info", mtu: defaultMTU}); key.Proxy != tt.url {
+			t.Errorf("key.Proxy = %q, want %q", key.Proxy, tt.url)
+		}
+	}
+
+	for _, s := range []string{
+		"ss://no-such-cipher:secret@1.2.3.4:8388",
+		"ss://" + base64.StdEncoding.EncodeToString([]byte("garbage")),
+	} {
+		if err := validateProxy(s); err == nil {
+			t.Errorf("validateProxy(%q) = nil, want error", s)
+		}
+	}
+}
+
+func TestFailedHandshakeClosesConn(t *testing.T) {
+	tests := []struct {
+		scheme, reply string
+	}{
+		{"http", "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"},
+		{"socks4", "\x00\x5b\x00\x00\x00\x00\x00\x00"}, /* request rejected */
+	}
+	for _, tt := range tests {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		closed := make(chan error, 1)
+		go func() {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			c.Read(make([]byte, 512))
+			c.Write([]byte(tt.reply))
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err = c.Read(make([]byte, 1))
+			closed <- err
+		}()
+
+		p, err := parseProxy(tt.scheme + "://" + ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadata := &M.Metadata{Network: M.TCP, DstIP: net.IPv4(192, 0, 2, 1), DstPort: 443}
+		if _, err := p.DialContext(context.Background(), metadata); err == nil {
+			t.Errorf("%s DialContext = nil error on a rejected handshake", tt.scheme)
+			continue
+		}
+		if err := <-closed; err != io.EOF {
+			t.Errorf("%s proxy connection after a rejected handshake: read = %v, want EOF", tt.scheme, err)
+		}
+	}
+}
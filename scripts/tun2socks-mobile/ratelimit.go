@@ -0,0 +1,47 @@
+package tun2socks
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter caps the packets passing the TUN device; nil is unlimited.
+var rateLimiter atomic.Pointer[rate.Limiter]
+
+// SetRateLimit caps the combined upload and download throughput of the
+// tunnel at bytesPerSecond, e.g. 250000 for 2 Mbps; 0 removes the cap. It
+// applies immediately, to a running engine too.
+//
+// Packets are held back at the TUN device, so TCP senders slow down as on
+// a slow link. At most 50ms worth of traffic (and at least one packet) may
+// pass at once after an idle period, so the cap holds over short windows
+// as well.
+func SetRateLimit(bytesPerSecond int) error {
+	if bytesPerSecond < 0 {
+		return fmt.Errorf("invalid rate limit: %d", bytesPerSecond)
+	}
+	if bytesPerSecond == 0 {
+		rateLimiter.Store(nil)
+		return nil
+	}
+	rateLimiter.Store(rate.NewLimiter(rate.Limit(bytesPerSecond), rateBurst(bytesPerSecond)))
+	return nil
+}
+
+// rateBurst is the token bucket size for bytesPerSecond: 50ms worth, but no
+// less than the largest packet the device can carry.
+func rateBurst(bytesPerSecond int) int {
+	return max(bytesPerSecond/20, maxMTU)
+}
+
+// throttle waits until n bytes may pass the device, or ctx is done.
+func throttle(ctx context.Context, n int) {
+	l := rateLimiter.Load()
+	if l == nil || n == 0 {
+		return
+	}
+	l.WaitN(ctx, min(n, l.Burst()))
+}
@@ -0,0 +1,180 @@
+package tun2socks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+
+	"github.com/xjasonlyu/tun2socks/v2/core/option"
+	"github.com/xjasonlyu/tun2socks/v2/log"
+)
+
+// Reconfigure changes settings of the running engine in place, without
+// touching the TUN fd, e.g. to fit a new link after a Wi-Fi to cellular
+// handover. configJSON is an object with any of:
+//
+//	{
+//	  "mtu": 1400,
+//	  "tcpSendBufferSize": 1048576,
+//	  "tcpReceiveBufferSize": 1048576,
+//	  "dns": "1.1.1.1:53"
+//	}
+//
+// Fields left out stay unchanged; 0 or "" restores the default as for the
+// matching Set* function, which later Starts keep using. Buffer sizes and
+// DNS apply to new connections. A new mtu, which must
+// match the VpnService's, rebuilds the engine's netstack around the same
+// fd and resets the open connections; apps see them drop and reconnect.
+//
+// Any other field is an error naming it, and nothing is changed: use
+// Restart to switch proxies, and Stop and Start for the rest, such as
+// udpTimeoutSeconds, which the engine only takes while starting (see
+// SetUDPTimeout).
+func Reconfigure(configJSON string) error {
+	r, err := parseReconfig(configJSON)
+	if err != nil {
+		return err
+	}
+
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	s := currentSession
+	if s == nil {
+		return errors.New("not running")
+	}
+
+	if r.TCPSendBufferSize != nil {
+		options.tcpSendBufferSize = *r.TCPSendBufferSize
+		s.key.TCPSendBufferSize = bufferSizeKey(*r.TCPSendBufferSize)
+	}
+	if r.TCPReceiveBufferSize != nil {
+		options.tcpReceiveBufferSize = *r.TCPReceiveBufferSize
+		s.key.TCPReceiveBufferSize = bufferSizeKey(*r.TCPReceiveBufferSize)
+	}
+	if r.DNS != nil {
+		options.dnsIP, options.dnsPort = r.dnsIP, r.dnsPort
+		refreshDispatcher()
+	}
+
+	if r.MTU != nil && r.mtu != s.key.MTU {
+		s.key.MTU = r.mtu
+		if err := s.rebuildStack(); err != nil {
+			err = fmt.Errorf("rebuild netstack: %w", err)
+			log.Errorf("[MOBILE] %v", err)
+			reportError(err)
+			stopLocked(0)
+			return err
+		}
+		log.Infof("[MOBILE] netstack rebuilt with mtu %d", r.mtu)
+		return nil
+	}
+	if r.TCPSendBufferSize != nil || r.TCPReceiveBufferSize != nil {
+		for _, opt := range liveBufferOptions(r) {
+			if err := opt(s.stack); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reconfig is the JSON form of the Reconfigure settings.
+type reconfig struct {
+	MTU                  *int    `json:"mtu"`
+	TCPSendBufferSize    *int    `json:"tcpSendBufferSize"`
+	TCPReceiveBufferSize *int    `json:"tcpReceiveBufferSize"`
+	DNS                  *string `json:"dns"`
+
+	// Parsed forms, set by parseReconfig.
+	mtu     int
+	dnsIP   net.IP
+	dnsPort uint16
+}
+
+// reconfigFields are the JSON names reconfig accepts.
+var reconfigFields = map[string]bool{
+	"mtu":                  true,
+	"tcpSendBufferSize":    true,
+	"tcpReceiveBufferSize": true,
+	"dns":                  true,
+}
+
+// parseReconfig decodes and validates s, rejecting fields that cannot be
+// changed live.
+func parseReconfig(s string) (*reconfig, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(s), &fields); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	var fixed []string
+	for name := range fields {
+		if !reconfigFields[name] {
+			fixed = append(fixed, name)
+		}
+	}
+	if len(fixed) > 0 {
+		sort.Strings(fixed)
+		return nil, fmt.Errorf("cannot change live: %s", strings.Join(fixed, ", "))
+	}
+
+	r := &reconfig{}
+	if err := json.Unmarshal([]byte(s), r); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if r.MTU != nil {
+		if r.mtu = *r.MTU; r.mtu == 0 {
+			r.mtu = defaultMTU
+		} else if r.mtu < minMTU || r.mtu > maxMTU {
+			return nil, fmt.Errorf("invalid mtu %d: must be between %d and %d", r.mtu, minMTU, maxMTU)
+		}
+	}
+	for _, size := range []*int{r.TCPSendBufferSize, r.TCPReceiveBufferSize} {
+		if size != nil && *size != 0 && (*size < minTCPBufferSize || *size > maxTCPBufferSize) {
+			return nil, fmt.Errorf("invalid tcp buffer size %d: must be between %d and %d",
+				*size, minTCPBufferSize, maxTCPBufferSize)
+		}
+	}
+	if r.DNS != nil && *r.DNS != "" {
+		var err error
+		if r.dnsIP, r.dnsPort, err = splitIPPort(*r.DNS); err != nil {
+			return nil, fmt.Errorf("invalid config: dns: %w", err)
+		}
+	}
+	return r, nil
+}
+
+// bufferSizeKey is the engine.Key form of a TCP buffer size option.
+func bufferSizeKey(size int) string {
+	if size == 0 {
+		return ""
+	}
+	return strconv.Itoa(size)
+}
+
+// liveBufferOptions returns the stack options for the buffer sizes set in
+// r, with 0 restoring the netstack default.
+func liveBufferOptions(r *reconfig) []option.Option {
+	var opts []option.Option
+	if r.TCPSendBufferSize != nil {
+		size := *r.TCPSendBufferSize
+		if size == 0 {
+			size = tcp.DefaultSendBufferSize
+		}
+		opts = append(opts, option.WithTCPSendBufferSize(size))
+	}
+	if r.TCPReceiveBufferSize != nil {
+		size := *r.TCPReceiveBufferSize
+		if size == 0 {
+			size = tcp.DefaultReceiveBufferSize
+		}
+		opts = append(opts, option.WithTCPReceiveBufferSize(size))
+	}
+	return opts
+}
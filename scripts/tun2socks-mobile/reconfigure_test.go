@@ -0,0 +1,86 @@
+package tun2socks
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseReconfigInvalid(t *testing.T) {
+	tests := []struct {
+		json string
+		want string
+	}{
+		{`not json`, "invalid config"},
+		{`{"proxy": "socks5://127.0.0.1:1080", "mtu": 1400, "logLevel": "debug"}`, "cannot change live: logLevel, proxy"},
+		{`{"mtu": 100}`, "invalid mtu"},
+		{`{"mtu": "1400"}`, "mtu"},
+		{`{"tcpSendBufferSize": 1}`, "invalid tcp buffer size"},
+		{`{"udpTimeoutSeconds": 30}`, "cannot change live: udpTimeoutSeconds"},
+		{`{"dns": "dns.google"}`, "dns"},
+	}
+	for _, tt := range tests {
+		_, err := parseReconfig(tt.json)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseReconfig(%s) = %v, want error mentioning %q", tt.json, err, tt.want)
+		}
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	defer Stop()
+	defer SetDNS("")
+	defer SetTCPBufferSize(0, 0)
+
+	if err := Reconfigure(`{"mtu": 1400}`); err == nil {
+		t.Error("Reconfigure = nil when not running, want an error")
+	}
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[1])
+	if err := Start(fds[0], "socks5://127.0.0.1:1080", "silent"); err != nil {
+		t.Fatalf("Start = %v", err)
+	}
+
+	if err := Reconfigure(`{"mtu": 1400, "tcpSendBufferSize": 65536, "dns": "1.1.1.1:53"}`); err != nil {
+		t.Fatalf("Reconfigure = %v", err)
+	}
+	if !Running() {
+		t.Fatal("Running() = false after Reconfigure")
+	}
+	var c effectiveConfig
+	if err := json.Unmarshal([]byte(CurrentConfig()), &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.MTU != 1400 || c.TCPSendBuffer != "65536" || c.DNS != "1.1.1.1:53" {
+		t.Errorf("CurrentConfig() = %+v after Reconfigure", c)
+	}
+
+	// The rebuilt netstack must read the same fd.
+	packet := make([]byte, 20)
+	packet[0] = 0x45 /* IPv4 */
+	if _, err := unix.Write(fds[1], packet); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for rxPackets() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no packet read from the TUN fd after Reconfigure")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Buffer changes alone apply to the running stack.
+	if err := Reconfigure(`{"tcpReceiveBufferSize": 0}`); err != nil {
+		t.Errorf("Reconfigure = %v", err)
+	}
+	if err := Reconfigure(`{"proxy": "socks5://127.0.0.1:1081"}`); err == nil {
+		t.Error("Reconfigure(proxy) = nil, want an error")
+	}
+}
@@ -0,0 +1,170 @@
+package tun2socks
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/log"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+)
+
+const (
+	// reconnectFailures is how many dials in a row must find the proxy
+	// unreachable before auto-reconnect kicks in.
+	reconnectFailures = 3
+
+	// defaultMaxBackoff caps the retry delay when SetAutoReconnect is given
+	// no maximum.
+	defaultMaxBackoff = 30 * time.Second
+)
+
+// reconnectBackoff is the delay before the first retry; a var for tests.
+var reconnectBackoff = 500 * time.Millisecond
+
+// SetAutoReconnect makes the engine recover by itself when the proxy goes
+// away, e.g. on a server restart or IP rotation. It applies immediately,
+// to a running engine too.
+//
+// Once three dials in a row fail to reach the proxy, the engine reports
+// "reconnecting" and probes the proxy (as StartChecked does) after a
+// delay that starts at 500ms and doubles up to maxBackoffMs. On success it
+// rebuilds the upstream from the proxy URL, or the StartMulti list with
+// all its proxies healthy again, and reports "connected". The TUN device
+// stays up meanwhile, so traffic does not leak around the tunnel.
+//
+// With maxBackoffMs > 0 it gives up once a retry at the maximum delay has
+// failed too: the engine stops with "error" and LastError says why. With
+// 0 it retries until Stop, at most 30 seconds apart. Stop always ends the
+// retries.
+func SetAutoReconnect(enabled bool, maxBackoffMs int) error {
+	if maxBackoffMs < 0 {
+		return fmt.Errorf("invalid max backoff: %d", maxBackoffMs)
+	}
+
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	options.autoReconnect = enabled
+	options.maxBackoff = time.Duration(maxBackoffMs) * time.Millisecond
+	refreshDispatcher()
+	return nil
+}
+
+// upstreamHealth counts consecutive dials that could not reach the proxy.
+type upstreamHealth struct {
+	failures atomic.Int32
+	onDown   func()
+}
+
+func (h *upstreamHealth) record(err error) {
+	if h == nil {
+		return
+	}
+	if err == nil {
+		h.failures.Store(0)
+		return
+	}
+	if proxyUnreachable(err) && h.failures.Add(1) == reconnectFailures {
+		h.onDown()
+	}
+}
+
+// setUpstream routes new flows of s through upstream, with a fresh
+// dispatcher. Callers must hold lifecycleMu.
+func (s *session) setUpstream(upstream proxy.Proxy) {
+	s.upstream = upstream
+	d := newDispatcher(upstream)
+	d.ctx = s.ctx
+	s.dispatcher = d
+	if options.autoReconnect {
+		d.health = &upstreamHealth{onDown: func() { go s.reconnect() }}
+	}
+	activeDispatcher.Store(d)
+}
+
+// freshUpstream builds a new upstream from the proxy URLs of s, falling
+// back to the current one if that fails. Callers must hold lifecycleMu.
+func (s *session) freshUpstream() proxy.Proxy {
+	upstream, err := newUpstream(&startParams{proxyUrl: s.key.Proxy, proxyUrls: s.proxyUrls})
+	if err != nil {
+		log.Warnf("[MOBILE] rebuild upstream: %v", err)
+		return s.upstream
+	}
+	return upstream
+}
+
+// stopReconnect ends the reconnect loop of s, if running. Callers must hold
+// lifecycleMu.
+func (s *session) stopReconnect() {
+	if s.reconnectDone != nil {
+		close(s.reconnectDone)
+		s.reconnectDone = nil
+	}
+}
+
+// reconnect probes the proxy with backoff until it answers, s is stopped,
+// or the retries are given up.
+func (s *session) reconnect() {
+	lifecycleMu.Lock()
+	if currentSession != s || s.reconnectDone != nil || !options.autoReconnect {
+		lifecycleMu.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	s.reconnectDone = done
+	limit := options.maxBackoff
+	probeAddr := options.probeAddr
+	timeout := options.dialTimeout
+	lifecycleMu.Unlock()
+
+	if timeout == 0 {
+		timeout = defaultDialTimeout
+	}
+	maxBackoff := limit
+	if maxBackoff == 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	log.Warnf("[MOBILE] proxy unreachable, reconnecting")
+
+	for backoff := min(reconnectBackoff, maxBackoff); ; backoff = min(backoff*2, maxBackoff) {
+		notifyState(StateReconnecting)
+		select {
+		case <-done:
+			return
+		case <-time.After(backoff):
+		}
+
+		lifecycleMu.Lock()
+		upstream := s.upstream
+		lifecycleMu.Unlock()
+		err := probeProxy(upstream, probeAddr, timeout)
+
+		lifecycleMu.Lock()
+		if s.reconnectDone != done {
+			// Stopped while probing.
+			lifecycleMu.Unlock()
+			return
+		}
+		if err == nil {
+			s.reconnectDone = nil
+			s.setUpstream(s.freshUpstream())
+			counters.reconnects.Add(1)
+			log.Infof("[MOBILE] proxy %s://%s reachable again", upstream.Proto(), upstream.Addr())
+			notifyState(StateConnected)
+			lifecycleMu.Unlock()
+			return
+		}
+		log.Warnf("[MOBILE] reconnect: %v", err)
+		if limit > 0 && backoff >= limit {
+			s.reconnectDone = nil
+			reportError(fmt.Errorf("proxy unreachable, gave up reconnecting: %w", err))
+			if err := stopLocked(0); err != nil {
+				log.Warnf("[MOBILE] %v", err)
+			}
+			lifecycleMu.Unlock()
+			return
+		}
+		lifecycleMu.Unlock()
+	}
+}
@@ -0,0 +1,176 @@
+package tun2socks
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+)
+
+// deadAddr returns a loopback address nothing listens on.
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// failDials dials through the engine's dialer as new flows would.
+func failDials(n int) {
+	metadata := &M.Metadata{Network: M.TCP, DstIP: net.IPv4(192, 0, 2, 1), DstPort: 443}
+	for i := 0; i < n; i++ {
+		if c, err := proxy.Dial(metadata); err == nil {
+			c.Close()
+		}
+	}
+}
+
+func countState(states []string, state string) int {
+	n := 0
+	for _, s := range states {
+		if s == state {
+			n++
+		}
+	}
+	return n
+}
+
+func TestAutoReconnectGivesUp(t *testing.T) {
+	defer func(d time.Duration) { reconnectBackoff = d }(reconnectBackoff)
+	reconnectBackoff = 20 * time.Millisecond
+	defer Stop()
+	defer SetAutoReconnect(false, 0)
+
+	rec := &stateRecorder{}
+	SetStateListener(rec)
+	defer SetStateListener(nil)
+
+	if err := SetAutoReconnect(true, 80); err != nil {
+		t.Fatal(err)
+	}
+	if err := Start(testTunFd(t), "socks5://"+deadAddr(t), "silent"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	failDials(reconnectFailures)
+
+	for Running() {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("engine still running, want it to give up reconnecting")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// Retries after 20, 40 and 80ms, then it gives up.
+	if elapsed := time.Since(start); elapsed < 140*time.Millisecond {
+		t.Errorf("gave up after %v, want at least the 140ms of backoff", elapsed)
+	}
+	time.Sleep(50 * time.Millisecond)
+	states := rec.get()
+	if n := countState(states, StateReconnecting); n != 3 {
+		t.Errorf("states = %v, want 3 reconnect attempts", states)
+	}
+	if countState(states, StateError) != 1 || states[len(states)-1] != StateStopped {
+		t.Errorf("states = %v, want error then stopped", states)
+	}
+	if msg := LastError(); !strings.Contains(msg, "gave up reconnecting") {
+		t.Errorf("LastError() = %q", msg)
+	}
+}
+
+func TestAutoReconnectRebuildsUpstream(t *testing.T) {
+	defer func(d time.Duration) { reconnectBackoff = d }(reconnectBackoff)
+	reconnectBackoff = 10 * time.Millisecond
+	defer Stop()
+	defer SetAutoReconnect(false, 0)
+
+	if err := SetAutoReconnect(true, 0); err != nil {
+		t.Fatal(err)
+	}
+	addr := deadAddr(t)
+	if err := Start(testTunFd(t), "http://"+addr, "silent"); err != nil {
+		t.Fatal(err)
+	}
+	lifecycleMu.Lock()
+	before := currentSession.upstream
+	lifecycleMu.Unlock()
+	failDials(reconnectFailures)
+
+	// The proxy comes back, answering every CONNECT.
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			c.Close()
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for counters.reconnects.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no reconnect after the proxy came back")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	lifecycleMu.Lock()
+	after := currentSession.upstream
+	lifecycleMu.Unlock()
+	if after == before {
+		t.Error("upstream after reconnect is the old proxy, want a rebuilt one")
+	}
+	if after.Addr() != addr {
+		t.Errorf("upstream after reconnect = %s, want %s", after.Addr(), addr)
+	}
+}
+
+func TestAutoReconnectStop(t *testing.T) {
+	defer func(d time.Duration) { reconnectBackoff = d }(reconnectBackoff)
+	reconnectBackoff = 10 * time.Millisecond
+	defer SetAutoReconnect(false, 0)
+
+	rec := &stateRecorder{}
+	SetStateListener(rec)
+	defer SetStateListener(nil)
+
+	// Without a maximum it retries until Stop.
+	if err := SetAutoReconnect(true, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := Start(testTunFd(t), "socks5://"+deadAddr(t), "silent"); err != nil {
+		t.Fatal(err)
+	}
+	failDials(reconnectFailures)
+	time.Sleep(200 * time.Millisecond)
+	if !Running() {
+		t.Fatal("engine stopped, want it to keep retrying")
+	}
+	Stop()
+
+	n := countState(rec.get(), StateReconnecting)
+	if n < 2 {
+		t.Errorf("%d reconnect attempts before Stop, want several", n)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if got := countState(rec.get(), StateReconnecting); got != n {
+		t.Errorf("%d reconnect attempts after Stop, want none", got-n)
+	}
+}
+
+func TestSetAutoReconnectInvalid(t *testing.T) {
+	if err := SetAutoReconnect(true, -1); err == nil {
+		t.Error("SetAutoReconnect(true, -1) = nil, want error")
+	}
+}
@@ -0,0 +1,51 @@
+package tun2socks
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// StartWithAPI is like Start but also serves the engine's REST API (stats,
+// connections, logs) on apiListen, e.g. "127.0.0.1:8080", reachable from
+// the device or through `adb forward`. A token can be required with
+// "http://token@127.0.0.1:8080". An empty apiListen disables the API.
+//
+// Only loopback addresses are accepted so the API is never exposed on the
+// network. The engine cannot shut the API server down: it keeps serving
+// after Stop and reports on whichever session is running.
+func StartWithAPI(tunFd int, proxyUrl, logLevel, apiListen string) error {
+	if apiListen != "" {
+		if err := validateRestAPI(apiListen); err != nil {
+			return err
+		}
+	}
+	return start(&startParams{tunFd: tunFd, proxyUrl: proxyUrl, logLevel: logLevel, restAPI: apiListen})
+}
+
+// validateRestAPI checks s is an http listen address on loopback.
+func validateRestAPI(s string) error {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid api address: %w", err)
+	}
+	if u.Scheme != "http" {
+		return fmt.Errorf("invalid api address: unsupported scheme %q", u.Scheme)
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return fmt.Errorf("invalid api address: %w", err)
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return fmt.Errorf("invalid api address: bad port %q", port)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("invalid api address: %q is not a loopback address", host)
+	}
+	return nil
+}
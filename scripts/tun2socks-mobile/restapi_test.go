@@ -0,0 +1,28 @@
+package tun2socks
+
+import "testing"
+
+func TestValidateRestAPI(t *testing.T) {
+	for _, s := range []string{
+		"127.0.0.1:8080",
+		"localhost:9090",
+		"[::1]:8080",
+		"http://secret@127.0.0.1:8080",
+	} {
+		if err := validateRestAPI(s); err != nil {
+			t.Errorf("validateRestAPI(%q) = %v", s, err)
+		}
+	}
+	for _, s := range []string{
+		"0.0.0.0:8080",
+		":8080",
+		"[::]:8080",
+		"192.168.1.2:8080",
+		"127.0.0.1",
+		"https://127.0.0.1:8080",
+	} {
+		if err := validateRestAPI(s); err == nil {
+			t.Errorf("validateRestAPI(%q) = nil, want error", s)
+		}
+	}
+}
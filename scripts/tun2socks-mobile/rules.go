@@ -0,0 +1,220 @@
+package tun2socks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Domain rule actions.
+const (
+	actionProxy  = "proxy"
+	actionDirect = "direct"
+)
+
+const (
+	// minDomainTTL is the shortest time a resolved address stays mapped to
+	// its name. Apps often cache answers past their TTL.
+	minDomainTTL = 5 * time.Minute
+
+	// maxDomainIPs bounds the address-to-name map.
+	maxDomainIPs = 8192
+)
+
+// SetDomainRules routes connections by destination domain. rulesJSON is a
+// list of rules; the first whose pattern matches decides:
+//
+//	[
+//	  {"pattern": "example.com", "action": "direct"},
+//	  {"pattern": "*.corp.example", "action": "proxy"}
+//	]
+//
+// A pattern is either an exact name or "*." followed by a suffix, which
+// matches every subdomain but not the suffix itself. "direct" dials
+// without the proxy; "proxy" always uses it, even for a bypassed CIDR.
+// An empty string clears the rules.
+//
+// The engine only sees IP packets, so domains are learned from the plain
+// DNS answers (UDP port 53) passing through the tunnel. Connections to
+// literal IPs, or to names resolved via DoH/DoT or before the tunnel came
+// up, are not matched. Set before Start; on error the previous rules are
+// kept.
+func SetDomainRules(rulesJSON string) error {
+	rules, err := parseDomainRules(rulesJSON)
+	if err != nil {
+		return err
+	}
+
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	options.domainRules = rules
+	return nil
+}
+
+type domainRule struct {
+	Pattern string `json:"pattern"`
+	Action  string `json:"action"`
+}
+
+func parseDomainRules(s string) ([]domainRule, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var rules []domainRule
+	if err := json.Unmarshal([]byte(s), &rules); err != nil {
+		return nil, fmt.Errorf("invalid domain rules: %w", err)
+	}
+	for i := range rules {
+		r := &rules[i]
+		r.Pattern = strings.ToLower(strings.TrimSuffix(r.Pattern, "."))
+		if !validDomainPattern(r.Pattern) {
+			return nil, fmt.Errorf("invalid domain rule %d: bad pattern %q", i, r.Pattern)
+		}
+		if r.Action != actionProxy && r.Action != actionDirect {
+			return nil, fmt.Errorf("invalid domain rule %d: action %q is not %q or %q", i, r.Action, actionProxy, actionDirect)
+		}
+	}
+	return rules, nil
+}
+
+func validDomainPattern(p string) bool {
+	p = strings.TrimPrefix(p, "*.")
+	if p == "" || len(p) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(p, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (r *domainRule) match(name string) bool {
+	if suffix, ok := strings.CutPrefix(r.Pattern, "*"); ok {
+		return strings.HasSuffix(name, suffix)
+	}
+	return name == r.Pattern
+}
+
+// matchDomain returns the action of the first rule matching name, or "".
+func matchDomain(rules []domainRule, name string) string {
+	for i := range rules {
+		if rules[i].match(name) {
+			return rules[i].Action
+		}
+	}
+	return ""
+}
+
+// domainIPs maps addresses seen in DNS answers to the name queried.
+var domainIPs = struct {
+	sync.Mutex
+	m map[string]domainIP
+}{m: map[string]domainIP{}}
+
+type domainIP struct {
+	name    string
+	expires time.Time
+}
+
+// domainOf returns the name ip was last resolved from, or "".
+func domainOf(ip net.IP) string {
+	domainIPs.Lock()
+	defer domainIPs.Unlock()
+
+	e, ok := domainIPs.m[ip.String()]
+	if !ok || time.Now().After(e.expires) {
+		return ""
+	}
+	return e.name
+}
+
+func recordDomainIP(ip net.IP, name string, ttl time.Duration) {
+	if ttl < minDomainTTL {
+		ttl = minDomainTTL
+	}
+	now := time.Now()
+
+	domainIPs.Lock()
+	defer domainIPs.Unlock()
+
+	if len(domainIPs.m) >= maxDomainIPs {
+		for k, e := range domainIPs.m {
+			if now.After(e.expires) {
+				delete(domainIPs.m, k)
+			}
+		}
+		if len(domainIPs.m) >= maxDomainIPs {
+			return
+		}
+	}
+	domainIPs.m[ip.String()] = domainIP{name: name, expires: now.Add(ttl)}
+}
+
+// recordDNSAnswer records the A and AAAA answers of a DNS response.
+// Anything that does not parse is ignored.
+func recordDNSAnswer(msg []byte) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil || !h.Response {
+		return
+	}
+	q, err := p.Question()
+	if err != nil {
+		return
+	}
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	for {
+		ah, err := p.AnswerHeader()
+		if err != nil {
+			return
+		}
+		ttl := time.Duration(ah.TTL) * time.Second
+		switch ah.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return
+			}
+			recordDomainIP(r.A[:], name, ttl)
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return
+			}
+			recordDomainIP(r.AAAA[:], name, ttl)
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// dnsSnoopConn records the answers read from a DNS flow.
+type dnsSnoopConn struct {
+	net.PacketConn
+}
+
+func (c *dnsSnoopConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err == nil {
+		recordDNSAnswer(b[:n])
+	}
+	return n, addr, err
+}
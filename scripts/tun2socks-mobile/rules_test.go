@@ -0,0 +1,79 @@
+package tun2socks
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+)
+
+func TestParseDomainRulesInvalid(t *testing.T) {
+	for _, s := range []string{
+		`{"pattern": "example.com"}`,
+		`[{"pattern": "", "action": "direct"}]`,
+		`[{"pattern": "ex ample.com", "action": "direct"}]`,
+		`[{"pattern": "*example.com", "action": "direct"}]`,
+		`[{"pattern": "a.*.com", "action": "direct"}]`,
+		`[{"pattern": "example.com", "action": "block"}]`,
+	} {
+		if _, err := parseDomainRules(s); err == nil {
+			t.Errorf("parseDomainRules(%s) = nil error", s)
+		}
+	}
+}
+
+func TestMatchDomain(t *testing.T) {
+	rules, err := parseDomainRules(`[
+		{"pattern": "Example.com.", "action": "direct"},
+		{"pattern": "*.example.com", "action": "proxy"}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct{ name, want string }{
+		{"example.com", actionDirect},
+		{"www.example.com", actionProxy},
+		{"a.b.example.com", actionProxy},
+		{"badexample.com", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := matchDomain(rules, tt.name); got != tt.want {
+			t.Errorf("matchDomain(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDomainRulesRoute(t *testing.T) {
+	if err := SetDomainRules(`[{"pattern": "*.direct.test", "action": "direct"}]`); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDomainRules("")
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	b.StartQuestions()
+	name := dnsmessage.MustNewName("WWW.direct.test.")
+	b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	b.StartAnswers()
+	b.AResource(dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: 60},
+		dnsmessage.AResource{A: [4]byte{203, 0, 113, 7}})
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordDNSAnswer(msg)
+
+	upstream := proxy.NewReject()
+	d := newDispatcher(upstream)
+	metadata := &M.Metadata{Network: M.TCP, DstIP: net.IPv4(203, 0, 113, 7), DstPort: 443}
+	if p := d.route(metadata); p == upstream {
+		t.Error("route(www.direct.test) = upstream, want direct")
+	}
+	metadata = &M.Metadata{Network: M.TCP, DstIP: net.IPv4(203, 0, 113, 8), DstPort: 443}
+	if p := d.route(metadata); p != upstream {
+		t.Error("route(unresolved) != upstream")
+	}
+}
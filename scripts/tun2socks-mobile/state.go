@@ -0,0 +1,103 @@
+package tun2socks
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/log"
+)
+
+// Tunnel states reported to a StateListener.
+const (
+	StateStarting  = "starting"
+	StateConnected = "connected"
+	StateStopping  = "stopping"
+	StateStopped   = "stopped"
+	StateError     = "error"
+
+	// StateReconnecting is reported while auto-reconnect is retrying an
+	// unreachable proxy; see SetAutoReconnect.
+	StateReconnecting = "reconnecting"
+)
+
+const (
+	// stateQueueSize bounds the transitions waiting for the listener.
+	stateQueueSize = 64
+
+	// stateFlushTimeout bounds how long Stop waits for the listener to
+	// receive the final "stopped".
+	stateFlushTimeout = time.Second
+)
+
+// StateListener is notified of tunnel state transitions: "starting",
+// "connected", "stopping", "stopped", "error" and "reconnecting".
+type StateListener interface {
+	OnStateChanged(state string)
+}
+
+type stateListenerHolder struct{ l StateListener }
+
+type stateEvent struct {
+	state     string
+	delivered chan struct{}
+}
+
+var (
+	stateListener atomic.Pointer[stateListenerHolder]
+	stateEvents   = make(chan stateEvent, stateQueueSize)
+)
+
+func init() {
+	go deliverStates()
+}
+
+// SetStateListener registers l for state transitions; nil removes it.
+//
+// Transitions are delivered in order on a dedicated goroutine, so a slow
+// listener never holds up Start, Stop or packet processing. Stop waits
+// briefly for "stopped" to be delivered, so it is not lost when Stop is
+// called while the app is shutting down. The process being killed without
+// Stop cannot be observed from Go; call Stop from onDestroy()/onRevoke().
+func SetStateListener(l StateListener) {
+	if l == nil {
+		stateListener.Store(nil)
+		return
+	}
+	stateListener.Store(&stateListenerHolder{l: l})
+}
+
+func deliverStates() {
+	for e := range stateEvents {
+		if h := stateListener.Load(); h != nil {
+			h.l.OnStateChanged(e.state)
+		}
+		if e.delivered != nil {
+			close(e.delivered)
+		}
+	}
+}
+
+// notifyState queues a transition for the listener without blocking.
+func notifyState(state string) {
+	select {
+	case stateEvents <- stateEvent{state: state}:
+	default:
+		log.Warnf("[MOBILE] state listener is behind, dropped %q", state)
+	}
+}
+
+// notifyStateSync queues a transition and waits until the listener has
+// received it or stateFlushTimeout elapses.
+func notifyStateSync(state string) {
+	e := stateEvent{state: state, delivered: make(chan struct{})}
+	select {
+	case stateEvents <- e:
+	default:
+		log.Warnf("[MOBILE] state listener is behind, dropped %q", state)
+		return
+	}
+	select {
+	case <-e.delivered:
+	case <-time.After(stateFlushTimeout):
+	}
+}
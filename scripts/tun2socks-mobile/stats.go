@@ -0,0 +1,85 @@
+package tun2socks
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/statistic"
+)
+
+// TrafficStats holds cumulative proxied traffic in bytes.
+type TrafficStats struct {
+	Up   int64
+	Down int64
+}
+
+// Stats returns the bytes sent (Up) and received (Down) through the proxy
+// since the last Start or ResetStats.
+func Stats() *TrafficStats {
+	m := collectMetrics()
+	return &TrafficStats{Up: m.up, Down: m.down}
+}
+
+// ResetStats zeroes the traffic counters, and the dial failure and
+// reconnect counts, without touching the engine.
+func ResetStats() {
+	statistic.DefaultManager.ResetStatistic()
+	counters.dialFailures.Store(0)
+	counters.reconnects.Store(0)
+}
+
+// ConnectionCounts holds the number of flows the engine is tracking.
+type ConnectionCounts struct {
+	TCP int
+	UDP int
+}
+
+// ConnectionCount returns the TCP and UDP flows currently open through the
+// engine, or zeros when it is not running. It only reads the engine's
+// connection table and is cheap enough to poll every few seconds.
+func ConnectionCount() *ConnectionCounts {
+	m := collectMetrics()
+	return &ConnectionCounts{TCP: m.tcpFlows, UDP: m.udpFlows}
+}
+
+// counters are the wrapper's own counts, next to the engine's traffic
+// totals. They are reset with them by ResetStats.
+var counters struct {
+	// dialFailures counts flows the upstream proxy could not be dialed for.
+	dialFailures atomic.Int64
+	// reconnects counts recoveries by auto-reconnect.
+	reconnects atomic.Int64
+}
+
+// metrics is a snapshot of every counter the wrapper reports.
+type metrics struct {
+	running            bool
+	up, down           int64
+	tcpFlows, udpFlows int
+	dialFailures       int64
+	reconnects         int64
+}
+
+// collectMetrics reads all counters at once.
+func collectMetrics() metrics {
+	snapshot := statistic.DefaultManager.Snapshot()
+	m := metrics{
+		running:      Running(),
+		up:           snapshot.UploadTotal,
+		down:         snapshot.DownloadTotal,
+		dialFailures: counters.dialFailures.Load(),
+		reconnects:   counters.reconnects.Load(),
+	}
+	if !m.running {
+		return m
+	}
+	for _, c := range snapshot.Connections {
+		switch c.(type) {
+		case net.Conn:
+			m.tcpFlows++
+		case net.PacketConn:
+			m.udpFlows++
+		}
+	}
+	return m
+}
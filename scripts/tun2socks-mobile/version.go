@@ -0,0 +1,45 @@
+package tun2socks
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// wrapperVersion is the version of this gomobile wrapper. Bump it whenever
+// the exported API changes: the minor version for additions, the major
+// one for changes that break callers.
+const wrapperVersion = "0.4.0"
+
+const engineModule = "github.com/xjasonlyu/tun2socks/v2"
+
+// engineVersion can be set at build time to override the engine version
+// read from the build info:
+//
+//	gomobile bind -ldflags "-X tun2socks.engineVersion=v2.5.2" ...
+var engineVersion string
+
+// Version returns the wrapper and engine versions compiled into this
+// library, e.g. "kotkit 0.4.0 / tun2socks v2.5.2".
+func Version() string {
+	return fmt.Sprintf("kotkit %s / tun2socks %s", wrapperVersion, linkedEngineVersion())
+}
+
+// linkedEngineVersion returns engineVersion, or the engine module version
+// recorded in the binary's build info, or "unknown".
+func linkedEngineVersion() string {
+	if engineVersion != "" {
+		return engineVersion
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range bi.Deps {
+			if dep.Path != engineModule {
+				continue
+			}
+			if dep.Replace != nil && dep.Replace.Version != "" {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
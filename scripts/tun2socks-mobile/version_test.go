@@ -0,0 +1,19 @@
+package tun2socks
+
+import "testing"
+
+func TestVersion(t *testing.T) {
+	// The test binary records its dependencies like a gomobile build.
+	if got := linkedEngineVersion(); got != "v2.5.2" {
+		t.Errorf("linkedEngineVersion() = %q, want the go.mod version v2.5.2", got)
+	}
+	if got, want := Version(), "kotkit "+wrapperVersion+" / tun2socks v2.5.2"; got != want {
+		t.Errorf("Version() = %q, want %q", got, want)
+	}
+
+	defer func(v string) { engineVersion = v }(engineVersion)
+	engineVersion = "v2.5.2-custom"
+	if got, want := Version(), "kotkit "+wrapperVersion+" / tun2socks v2.5.2-custom"; got != want {
+		t.Errorf("Version() with -X engineVersion = %q, want %q", got, want)
+	}
+}